@@ -9,6 +9,7 @@ import (
 
 	"github.com/USA-RedDragon/gitea-mirror/internal/config"
 	"github.com/USA-RedDragon/gitea-mirror/internal/mirror"
+	"github.com/USA-RedDragon/gitea-mirror/internal/server"
 	"github.com/spf13/cobra"
 	"github.com/ztrue/shutdown"
 )
@@ -42,9 +43,17 @@ func run(cmd *cobra.Command, _ []string) error {
 	}
 
 	mirrorInstance := mirror.New(config)
+	var httpServer *server.Server
+	if config.HTTPListen != "" {
+		httpServer = server.New(config.HTTPListen, mirrorInstance)
+		httpServer.Start()
+	}
 	stop := func(sig os.Signal) {
 		slog.Info("Shutting down")
 		mirrorInstance.Stop()
+		if httpServer != nil {
+			httpServer.Stop()
+		}
 		slog.Info("Shutdown complete")
 	}
 
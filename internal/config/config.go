@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/spf13/cobra"
@@ -28,6 +32,23 @@ type GiteaAuthConfig struct {
 	URL       string `json:"url"`
 	Token     string `json:"token"`
 	ReposPath string `json:"repos-path"`
+	// ReposPaths are more directories the sidecar finds repositories in, besides ReposPath
+	ReposPaths []string `json:"repos-paths"`
+}
+
+// RepoRoots returns every directory the sidecar finds repositories in, without duplicates
+func (g GiteaAuthConfig) RepoRoots() []string {
+	var roots []string
+	for _, root := range append([]string{g.ReposPath}, g.ReposPaths...) {
+		if root == "" {
+			continue
+		}
+		root = filepath.Clean(root)
+		if !slices.Contains(roots, root) {
+			roots = append(roots, root)
+		}
+	}
+	return roots
 }
 
 // Entity is the type of entity to mirror
@@ -38,42 +59,15 @@ var (
 	Organization Entity = "organization"
 )
 
-// FilterConfig is the configuration for filtering repositories
-type FilterConfig struct {
-	// Include is a list of regular expressions to include
-	Include []string `json:"include"`
-	// Exclude is a list of regular expressions to exclude
-	Exclude []string `json:"exclude"`
-
-	// OnlyArchived is a flag to only include archived repositories
-	OnlyArchived bool `json:"only-archived"`
-}
-
-// MatchInclusion returns true if the name matches any of the inclusion patterns
-func (f FilterConfig) MatchInclusion(name string) bool {
-	if len(f.Include) == 0 {
-		return true
-	}
-	for _, pattern := range f.Include {
-		if match, _ := regexp.MatchString(pattern, name); match {
-			return true
-		}
-	}
-	return false
-}
+// Direction is the direction a mirror copies repositories in
+type Direction string
 
-// MatchExclusion returns true if the name matches any of the exclusion patterns
-func (f FilterConfig) MatchExclusion(name string) bool {
-	if len(f.Exclude) == 0 {
-		return false
-	}
-	for _, pattern := range f.Exclude {
-		if match, _ := regexp.MatchString(pattern, name); match {
-			return true
-		}
-	}
-	return false
-}
+var (
+	// Pull mirrors GitHub repositories into Gitea
+	Pull Direction = "pull"
+	// Push mirrors Gitea repositories out to GitHub
+	Push Direction = "push"
+)
 
 // MirrorFromEntityConfig is the configuration for a single GitHub entity to mirror
 type MirrorFromEntityConfig struct {
@@ -85,42 +79,259 @@ type MirrorFromEntityConfig struct {
 
 // MirrorToEntityConfig is the configuration for a single Gitea entity to mirror to
 type MirrorToEntityConfig struct {
+	// Name is the Gitea owner to mirror to. It is a Go template rendered with NameData,
+	// so a literal name works as-is and "{{.Owner}}" follows the GitHub owner.
 	Name string `json:"name"`
+	// Repo is an optional Go template for the Gitea repository name, rendered with NameData.
+	// It defaults to the GitHub repository name.
+	Repo string `json:"repo"`
+
+	// OwnerReplace is a list of regular expression replacements applied to the rendered owner
+	OwnerReplace []ReplaceConfig `json:"owner-replace"`
+	// RepoReplace is a list of regular expression replacements applied to the rendered repository name
+	RepoReplace []ReplaceConfig `json:"repo-replace"`
+
+	// CreateOrg creates the destination owner as a Gitea organization when no user or
+	// organization by that name exists, copying the GitHub owner's profile and avatar
+	CreateOrg bool `json:"create-org"`
+	// Visibility is the visibility of created organizations: public, limited, or private.
+	// GitHub organizations are always public, so this defaults to public.
+	Visibility string `json:"visibility"`
+
+	ownerTemplate *template.Template
+	repoTemplate  *template.Template
+}
+
+// TeamSyncConfig is the configuration for syncing GitHub organization teams to Gitea teams
+type TeamSyncConfig struct {
+	// Enabled syncs the source organization's teams, their members, and their permissions
+	// on mirrored repositories onto teams in the destination organization
+	Enabled bool `json:"enabled"`
+	// Users maps GitHub usernames to Gitea usernames for users whose names differ
+	Users map[string]string `json:"users"`
+	// MatchByEmail maps GitHub users without a Gitea user of the same name by their public email
+	MatchByEmail bool `json:"match-by-email"`
+	// RemoveMembers removes Gitea team members who are not members of the GitHub team
+	RemoveMembers bool `json:"remove-members"`
+}
+
+// TopicSyncConfig is the configuration for syncing GitHub topics to Gitea
+type TopicSyncConfig struct {
+	// Enabled syncs the GitHub topics onto the Gitea repository on creation and every pass
+	Enabled bool `json:"enabled"`
+	// Prefix is an optional prefix added to each GitHub topic
+	Prefix string `json:"prefix"`
+	// Allow is an optional list of the GitHub topics to sync. All topics are synced when empty.
+	Allow []string `json:"allow"`
+	// Extra is a list of topics always added, such as mirrored-from-github
+	Extra []string `json:"extra"`
+}
+
+// defaultMaxReleases is the number of releases synced when MaxReleases is unset
+const defaultMaxReleases = 10
+
+// ReleaseSyncConfig is the configuration for syncing GitHub releases and their assets to Gitea
+type ReleaseSyncConfig struct {
+	// Enabled syncs releases and their assets on every pass
+	Enabled bool `json:"enabled"`
+	// MaxReleases is the number of most recent GitHub releases to sync, defaulting to 10
+	MaxReleases int `json:"max-releases"`
+	// MaxAssetSize is the size in bytes of the largest asset to upload. There is no limit when unset.
+	MaxAssetSize int64 `json:"max-asset-size"`
+	// Delete removes Gitea releases whose tag no longer has a GitHub release
+	Delete bool `json:"delete"`
+}
+
+// Limit returns the number of most recent releases to sync
+func (r ReleaseSyncConfig) Limit() int {
+	if r.MaxReleases == 0 {
+		return defaultMaxReleases
+	}
+	return r.MaxReleases
+}
+
+// IssueSyncConfig is the configuration for incrementally syncing issues after the initial migration
+type IssueSyncConfig struct {
+	// Enabled syncs new and updated issues, comments, and labels on every pass
+	Enabled bool `json:"enabled"`
+	// PullRequests also syncs pull requests. Gitea cannot open pull requests on a mirror,
+	// so new pull requests are created as issues with a pull-request label.
+	PullRequests bool `json:"pull-requests"`
+}
+
+// WikiSyncConfig is the configuration for keeping GitHub wikis in sync
+type WikiSyncConfig struct {
+	// Enabled mirrors the wiki of each repository that has one as a separate Gitea pull mirror,
+	// since Gitea only picks up a mirror's wiki if it existed when the mirror was created
+	Enabled bool `json:"enabled"`
+	// Suffix is added to the repository name to name the wiki mirror, defaulting to -wiki
+	Suffix string `json:"suffix"`
 }
 
 type MirrorConfig struct {
-	// Prefix is an optional prefix to add to the repository name
+	// Direction is either pull (the default), where From is a GitHub entity and To is a Gitea
+	// owner, or push, where From is a Gitea entity and To is a GitHub owner
+	Direction Direction `json:"direction"`
+
+	// Prefix is an optional prefix to add to the rendered repository name
 	Prefix string
-	// Suffix is an optional suffix to add to the repository name
+	// Suffix is an optional suffix to add to the rendered repository name
 	Suffix string
 
 	// From is the source entity to mirror
 	From MirrorFromEntityConfig
 	// To is the destination entity to mirror to
 	To MirrorToEntityConfig
+
+	// Teams is the configuration for syncing teams from an organization source
+	Teams TeamSyncConfig `json:"teams"`
+	// Topics is the configuration for syncing repository topics
+	Topics TopicSyncConfig `json:"topics"`
+	// Releases is the configuration for syncing releases and their assets
+	Releases ReleaseSyncConfig `json:"releases"`
+	// Issues is the configuration for incrementally syncing issues and pull requests
+	Issues IssueSyncConfig `json:"issues"`
+	// Wiki is the configuration for mirroring wikis
+	Wiki WikiSyncConfig `json:"wiki"`
+}
+
+//nolint:golint,gochecknoglobals
+var topicPattern = regexp.MustCompile(`^[a-z0-9][-.a-z0-9]*$`)
+
+// MaxTopics is the most topics Gitea allows on a repository
+const MaxTopics = 25
+
+// ValidTopic returns true if Gitea accepts the topic
+func ValidTopic(topic string) bool {
+	return len(topic) <= 35 && topicPattern.MatchString(topic)
+}
+
+// IsPush returns true if the mirror pushes Gitea repositories to GitHub
+func (m MirrorConfig) IsPush() bool {
+	return Direction(strings.ToLower(string(m.Direction))) == Push
 }
 
+// SidecarMode is how the sidecar rotates the tokens of mirrors
+type SidecarMode string
+
+var (
+	// SidecarFilesystem rewrites the git config of each repository under the repos paths
+	SidecarFilesystem SidecarMode = "filesystem"
+	// SidecarAPI re-creates push mirrors, and optionally pull mirrors, through the Gitea API,
+	// without filesystem access
+	SidecarAPI SidecarMode = "api"
+	// SidecarCredentials serves fresh installation tokens to git over HTTP as a credential helper
+	SidecarCredentials SidecarMode = "credentials"
+	// SidecarProxy proxies mirror fetches to GitHub, adding a fresh installation token to each request
+	SidecarProxy SidecarMode = "proxy"
+)
+
+// TokenScope is what the GitHub App installation tokens given to Gitea can access
+type TokenScope string
+
+var (
+	// TokenScopeRepository mints a token per repository, limited to the permissions mirroring it needs
+	TokenScopeRepository TokenScope = "repository"
+	// TokenScopeInstallation mints one token per installation with all of the installation's permissions
+	TokenScopeInstallation TokenScope = "installation"
+)
+
 // Config is the main configuration for the application
 type Config struct {
 	GitHubAuth GitHubAuthConfig `json:"github"`
 	GiteaAuth  GiteaAuthConfig  `json:"gitea"`
 	Mirrors    []MirrorConfig   `json:"mirrors"`
 	Sidecar    bool             `json:"sidecar"`
+	// SidecarMode is how the sidecar provides tokens: filesystem (the default), api, credentials, or proxy
+	SidecarMode SidecarMode `json:"sidecar-mode"`
+	// SidecarOwnedOnly limits token rotation to remotes owned by the account of the configured installation
+	SidecarOwnedOnly bool `json:"sidecar-owned-only"`
+	// SidecarRecreatePullMirrors lets the api sidecar rotate pull mirror tokens by migrating each
+	// pull mirror again and replacing the repository with the copy. Anything only stored in
+	// Gitea for the repository, such as its issues, releases, and webhooks, is lost.
+	SidecarRecreatePullMirrors bool `json:"sidecar-recreate-pull-mirrors"`
+	// SidecarListen is the address the credentials or proxy sidecar serves on
+	SidecarListen string `json:"sidecar-listen"`
+	// SidecarStripTokens removes the tokens embedded in GitHub remotes, so git asks the credentials sidecar instead
+	SidecarStripTokens bool `json:"sidecar-strip-tokens"`
+	// SidecarProxyURL is the URL Gitea reaches the proxy sidecar at. When set, new mirrors are
+	// created through the proxy without credentials.
+	SidecarProxyURL string `json:"sidecar-proxy-url"`
+	// TokenScope is what installation tokens can access, either repository (the default) or installation.
+	// Repository tokens are minted once per repository each time tokens are rotated, rather than
+	// once per installation, in exchange for exposing less when one leaks.
+	TokenScope TokenScope `json:"token-scope"`
+	// StatePath is the file that sync state, such as the last issue sync, is persisted to
+	StatePath string `json:"state-path"`
+	// HTTPListen is the address the metrics endpoint is served on. It is disabled when empty.
+	HTTPListen string `json:"http-listen"`
+	// HealthStallThreshold is how long the scheduler or sidecar loop can go without progress
+	// before /healthz fails
+	HealthStallThreshold Duration `json:"health-stall-threshold"`
 }
 
 //nolint:golint,gochecknoglobals
 var (
-	ConfigFileKey           = "config"
-	GitHubEnterpriseURLKey  = "github-enterprise-url"
-	GitHubAppIDKey          = "github-app-id"
-	GitHubInstallationIDKey = "github-install-id"
-	GitHubPrivateKeyPathKey = "github-private-key-path"
-	GitHubTokenKey          = "github-token"
-	GiteaURLKey             = "gitea-url"
-	GiteaTokenKey           = "gitea-token"
-	SidecarKey              = "sidecar"
+	ConfigFileKey                 = "config"
+	GitHubEnterpriseURLKey        = "github-enterprise-url"
+	GitHubAppIDKey                = "github-app-id"
+	GitHubInstallationIDKey       = "github-install-id"
+	GitHubPrivateKeyPathKey       = "github-private-key-path"
+	GitHubTokenKey                = "github-token"
+	GiteaURLKey                   = "gitea-url"
+	GiteaTokenKey                 = "gitea-token"
+	SidecarKey                    = "sidecar"
+	SidecarModeKey                = "sidecar-mode"
+	SidecarOwnedOnlyKey           = "sidecar-owned-only"
+	SidecarRecreatePullMirrorsKey = "sidecar-recreate-pull-mirrors"
+	TokenScopeKey                 = "token-scope"
+	SidecarListenKey              = "sidecar-listen"
+	SidecarStripTokensKey         = "sidecar-strip-tokens"
+	SidecarProxyURLKey            = "sidecar-proxy-url"
+	StatePathKey                  = "state-path"
+	HTTPListenKey                 = "http-listen"
+	HealthStallThresholdKey       = "health-stall-threshold"
 )
 
+// GetSidecarMode returns the sidecar mode, defaulting to filesystem
+func (c *Config) GetSidecarMode() SidecarMode {
+	if c.SidecarMode == "" {
+		return SidecarFilesystem
+	}
+	return SidecarMode(strings.ToLower(string(c.SidecarMode)))
+}
+
+// defaultSidecarListen only accepts local connections, since anyone who can reach the
+// credentials or proxy sidecar can use its tokens
+const defaultSidecarListen = "127.0.0.1:8080"
+
+// GetSidecarListen returns the address the credentials or proxy sidecar serves on
+func (c *Config) GetSidecarListen() string {
+	if c.SidecarListen == "" {
+		return defaultSidecarListen
+	}
+	return c.SidecarListen
+}
+
+// defaultHealthStallThreshold leaves room for the hourly schedule plus a long pass
+const defaultHealthStallThreshold = 3 * time.Hour
+
+// GetHealthStallThreshold returns the health stall threshold, defaulting to three hours
+func (c *Config) GetHealthStallThreshold() time.Duration {
+	if c.HealthStallThreshold <= 0 {
+		return defaultHealthStallThreshold
+	}
+	return time.Duration(c.HealthStallThreshold)
+}
+
+// GetTokenScope returns the token scope, defaulting to repository
+func (c *Config) GetTokenScope() TokenScope {
+	if c.TokenScope == "" {
+		return TokenScopeRepository
+	}
+	return TokenScope(strings.ToLower(string(c.TokenScope)))
+}
+
 func RegisterFlags(cmd *cobra.Command) {
 	cmd.Flags().StringP(ConfigFileKey, "c", "", "Config file path")
 	cmd.Flags().String(GitHubEnterpriseURLKey, "", "GitHub Enterprise URL")
@@ -131,6 +342,16 @@ func RegisterFlags(cmd *cobra.Command) {
 	cmd.Flags().String(GiteaURLKey, "", "Gitea URL")
 	cmd.Flags().String(GiteaTokenKey, "", "Gitea Token")
 	cmd.Flags().Bool(SidecarKey, false, "Run as a sidecar")
+	cmd.Flags().String(SidecarModeKey, string(SidecarFilesystem), "Sidecar token rotation mode: filesystem, api, credentials, or proxy")
+	cmd.Flags().Bool(SidecarOwnedOnlyKey, false, "Only rotate tokens of remotes owned by the configured GitHub App installation's account")
+	cmd.Flags().Bool(SidecarRecreatePullMirrorsKey, false, "Rotate pull mirror tokens in the api sidecar by re-creating the repositories, losing anything only stored in Gitea")
+	cmd.Flags().String(SidecarListenKey, defaultSidecarListen, "Address the credentials or proxy sidecar serves on")
+	cmd.Flags().Bool(SidecarStripTokensKey, false, "Remove tokens embedded in GitHub remotes when serving credentials")
+	cmd.Flags().String(SidecarProxyURLKey, "", "URL Gitea reaches the proxy sidecar at, to create mirrors through it")
+	cmd.Flags().String(TokenScopeKey, string(TokenScopeRepository), "Installation token scope: repository (one token per repository) or installation (one token per installation)")
+	cmd.Flags().String(StatePathKey, "", "Path to the sync state file")
+	cmd.Flags().String(HTTPListenKey, "", "Address to serve metrics and health checks on, disabled when empty")
+	cmd.Flags().String(HealthStallThresholdKey, defaultHealthStallThreshold.String(), "How long the scheduler or sidecar can go without progress before the liveness check fails")
 }
 
 func (c *Config) Validate() error {
@@ -160,6 +381,48 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("GitHub PAT and sidecar mode are mutually exclusive")
 	}
 
+	// Sidecar mode must be known, and filesystem mode needs the repositories
+	switch c.GetSidecarMode() {
+	case SidecarFilesystem:
+		if c.Sidecar && len(c.GiteaAuth.RepoRoots()) == 0 {
+			return fmt.Errorf("Gitea repos path is required for the filesystem sidecar")
+		}
+	case SidecarAPI:
+	case SidecarCredentials:
+		if c.Sidecar && c.SidecarStripTokens && len(c.GiteaAuth.RepoRoots()) == 0 {
+			return fmt.Errorf("Gitea repos path is required to strip tokens")
+		}
+	case SidecarProxy:
+	default:
+		return fmt.Errorf("sidecar mode %q is invalid", c.SidecarMode)
+	}
+
+	if c.SidecarRecreatePullMirrors && c.GetSidecarMode() != SidecarAPI {
+		return fmt.Errorf("re-creating pull mirrors requires the api sidecar mode")
+	}
+
+	if c.SidecarProxyURL != "" {
+		proxyURL, err := url.Parse(c.SidecarProxyURL)
+		if err != nil || proxyURL.Host == "" || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") {
+			return fmt.Errorf("sidecar proxy URL %q is invalid", c.SidecarProxyURL)
+		}
+	}
+
+	sidecarServes := c.GetSidecarMode() == SidecarCredentials || c.GetSidecarMode() == SidecarProxy
+	if c.HTTPListen != "" && c.Sidecar && sidecarServes && c.HTTPListen == c.GetSidecarListen() {
+		return fmt.Errorf("HTTP listen address %q is already used by the sidecar", c.HTTPListen)
+	}
+
+	if c.HealthStallThreshold < 0 {
+		return fmt.Errorf("health stall threshold must not be negative")
+	}
+
+	switch c.GetTokenScope() {
+	case TokenScopeRepository, TokenScopeInstallation:
+	default:
+		return fmt.Errorf("token scope %q is invalid", c.TokenScope)
+	}
+
 	// GitHub App ID is required if using GitHub App auth
 	if isAppAuth && c.GitHubAuth.AppID == 0 {
 		return fmt.Errorf("GitHub App ID is required")
@@ -228,6 +491,67 @@ func (c *Config) Validate() error {
 		if len(mirror.To.Name) == 0 {
 			return fmt.Errorf("mirror %d has no destination", i)
 		}
+		switch Direction(strings.ToLower(string(mirror.Direction))) {
+		case "", Pull:
+		case Push:
+			if mirror.To.CreateOrg || mirror.Teams.Enabled || mirror.Topics.Enabled || mirror.Releases.Enabled || mirror.Issues.Enabled || mirror.Wiki.Enabled {
+				return fmt.Errorf("mirror %d is a push mirror, which only supports filters and naming", i)
+			}
+		default:
+			return fmt.Errorf("mirror %d has an invalid direction", i)
+		}
+		if mirror.Teams.Enabled && strings.ToLower(string(mirror.From.Type)) != "organization" {
+			return fmt.Errorf("mirror %d can only sync teams from an organization", i)
+		}
+		if mirror.Topics.Prefix != "" && !ValidTopic(mirror.Topics.Prefix+"a") {
+			return fmt.Errorf("mirror %d has an invalid topic prefix", i)
+		}
+		for _, topic := range mirror.Topics.Extra {
+			if !ValidTopic(strings.ToLower(topic)) {
+				return fmt.Errorf("mirror %d has an invalid extra topic %q", i, topic)
+			}
+		}
+		if len(mirror.Topics.Extra) > MaxTopics {
+			return fmt.Errorf("mirror %d has more than %d extra topics", i, MaxTopics)
+		}
+		if mirror.Releases.MaxReleases < 0 || mirror.Releases.MaxAssetSize < 0 {
+			return fmt.Errorf("mirror %d has a negative release sync limit", i)
+		}
+		if mirror.Issues.Enabled && c.StatePath == "" {
+			return fmt.Errorf("mirror %d syncs issues, which requires a state path", i)
+		}
+		// Re-creating a pull mirror discards everything synced to it besides the git data
+		if c.SidecarRecreatePullMirrors && (mirror.Issues.Enabled || mirror.Releases.Enabled || mirror.Topics.Enabled || mirror.Teams.Enabled || mirror.Wiki.Enabled) {
+			return fmt.Errorf("mirror %d syncs issues, releases, topics, teams, or its wiki, which re-creating pull mirrors would lose", i)
+		}
+		switch strings.ToLower(mirror.To.Visibility) {
+		case "", "public", "limited", "private":
+		default:
+			return fmt.Errorf("mirror %d has an invalid destination visibility", i)
+		}
+	}
+
+	// Each mirror's filter patterns and naming templates must compile
+	for i := range c.Mirrors {
+		if err := c.Mirrors[i].From.Filter.Compile(); err != nil {
+			return fmt.Errorf("mirror %d has an invalid filter: %w", i, err)
+		}
+		if err := c.Mirrors[i].To.Compile(); err != nil {
+			return fmt.Errorf("mirror %d has an invalid destination: %w", i, err)
+		}
+		if err := c.Mirrors[i].CheckTarget(); err != nil {
+			return fmt.Errorf("mirror %d has an invalid destination: %w", i, err)
+		}
+		// Whether an expression reads custom properties is only known once it is compiled
+		if c.Mirrors[i].From.Filter.UsesCustomProperties() {
+			if c.Mirrors[i].IsPush() {
+				return fmt.Errorf("mirror %d is a push mirror, which cannot filter on custom properties", i)
+			}
+			// Custom properties are only defined by organizations
+			if strings.ToLower(string(c.Mirrors[i].From.Type)) != "organization" {
+				return fmt.Errorf("mirror %d can only filter on custom properties of an organization", i)
+			}
+		}
 	}
 
 	return nil
@@ -325,6 +649,82 @@ func LoadConfig(cmd *cobra.Command) (*Config, error) {
 		}
 	}
 
+	if cmd.Flags().Changed(SidecarModeKey) {
+		sidecarMode, err := cmd.Flags().GetString(SidecarModeKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar mode: %w", err)
+		}
+		config.SidecarMode = SidecarMode(sidecarMode)
+	}
+
+	if cmd.Flags().Changed(SidecarOwnedOnlyKey) {
+		config.SidecarOwnedOnly, err = cmd.Flags().GetBool(SidecarOwnedOnlyKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar owned only: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(SidecarRecreatePullMirrorsKey) {
+		config.SidecarRecreatePullMirrors, err = cmd.Flags().GetBool(SidecarRecreatePullMirrorsKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar recreate pull mirrors: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(SidecarListenKey) {
+		config.SidecarListen, err = cmd.Flags().GetString(SidecarListenKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar listen address: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(SidecarStripTokensKey) {
+		config.SidecarStripTokens, err = cmd.Flags().GetBool(SidecarStripTokensKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar strip tokens: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(SidecarProxyURLKey) {
+		config.SidecarProxyURL, err = cmd.Flags().GetString(SidecarProxyURLKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get sidecar proxy URL: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(TokenScopeKey) {
+		tokenScope, err := cmd.Flags().GetString(TokenScopeKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get token scope: %w", err)
+		}
+		config.TokenScope = TokenScope(tokenScope)
+	}
+
+	if cmd.Flags().Changed(StatePathKey) {
+		config.StatePath, err = cmd.Flags().GetString(StatePathKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get state path: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(HTTPListenKey) {
+		config.HTTPListen, err = cmd.Flags().GetString(HTTPListenKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get HTTP listen address: %w", err)
+		}
+	}
+
+	if cmd.Flags().Changed(HealthStallThresholdKey) {
+		threshold, err := cmd.Flags().GetString(HealthStallThresholdKey)
+		if err != nil {
+			return &config, fmt.Errorf("failed to get health stall threshold: %w", err)
+		}
+		config.HealthStallThreshold, err = ParseDuration(threshold)
+		if err != nil {
+			return &config, fmt.Errorf("failed to parse health stall threshold: %w", err)
+		}
+	}
+
 	err = config.Validate()
 	if err != nil {
 		return &config, fmt.Errorf("failed to validate config: %w", err)
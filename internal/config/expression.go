@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/ext"
+	"github.com/google/go-github/v62/github"
+)
+
+// expressionCostLimit bounds the work a single filter expression evaluation may perform
+const expressionCostLimit = 100000
+
+// expressionRepository is the repository object exposed to filter expressions as `repo`
+type expressionRepository struct {
+	Owner            string            `cel:"owner"`
+	Name             string            `cel:"name"`
+	Description      string            `cel:"description"`
+	Topics           []string          `cel:"topics"`
+	Visibility       string            `cel:"visibility"`
+	Archived         bool              `cel:"archived"`
+	Fork             bool              `cel:"fork"`
+	Language         string            `cel:"language"`
+	Size             int               `cel:"size"`
+	Stars            int               `cel:"stars"`
+	PushedAt         time.Time         `cel:"pushed_at"`
+	CustomProperties map[string]string `cel:"custom_properties"`
+}
+
+func newExpressionRepository(repo *github.Repository) expressionRepository {
+	topics := repo.Topics
+	if topics == nil {
+		topics = []string{}
+	}
+	customProperties := repo.CustomProperties
+	if customProperties == nil {
+		customProperties = map[string]string{}
+	}
+	return expressionRepository{
+		Owner:            repo.GetOwner().GetLogin(),
+		Name:             repo.GetName(),
+		Description:      repo.GetDescription(),
+		Topics:           topics,
+		Visibility:       RepositoryVisibility(repo),
+		Archived:         repo.GetArchived(),
+		Fork:             repo.GetFork(),
+		Language:         repo.GetLanguage(),
+		Size:             repo.GetSize(),
+		Stars:            repo.GetStargazersCount(),
+		PushedAt:         repo.GetPushedAt().Time,
+		CustomProperties: customProperties,
+	}
+}
+
+//nolint:golint,gochecknoglobals
+var expressionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	repoType := reflect.TypeOf(expressionRepository{})
+	return cel.NewEnv(
+		ext.NativeTypes(repoType, ext.ParseStructTags(true)),
+		ext.Strings(),
+		cel.Variable("repo", cel.ObjectType(repoType.String())),
+		cel.Variable("now", cel.TimestampType),
+	)
+})
+
+// compiledExpression is a type-checked filter expression
+type compiledExpression struct {
+	program cel.Program
+	// usesCustomProperties is true if the expression reads repo.custom_properties
+	usesCustomProperties bool
+}
+
+// compileExpression parses and type-checks a filter expression, which must evaluate to a bool
+func compileExpression(expression string) (*compiledExpression, error) {
+	env, err := expressionEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create expression environment: %w", err)
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression must evaluate to a bool, not %s", ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.CostLimit(expressionCostLimit))
+	if err != nil {
+		return nil, err
+	}
+	return &compiledExpression{
+		program:              program,
+		usesCustomProperties: selectsField(ast.NativeRep(), reflect.TypeOf(expressionRepository{}).String(), "custom_properties"),
+	}, nil
+}
+
+// selectsField returns true if the checked expression selects the field from an object of the type
+func selectsField(ast *celast.AST, typeName, field string) bool {
+	found := false
+	celast.PreOrderVisit(ast.Expr(), celast.NewExprVisitor(func(e celast.Expr) {
+		if e.Kind() != celast.SelectKind {
+			return
+		}
+		selected := e.AsSelect()
+		if selected.FieldName() == field && ast.GetType(selected.Operand().ID()).TypeName() == typeName {
+			found = true
+		}
+	}))
+	return found
+}
+
+// evalExpression evaluates a compiled filter expression against the repository
+func evalExpression(expression *compiledExpression, repo *github.Repository) (bool, error) {
+	out, _, err := expression.program.Eval(map[string]any{
+		"repo": newExpressionRepository(repo),
+		"now":  time.Now(),
+	})
+	if err != nil {
+		return false, err
+	}
+	match, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %s, not a bool", out.Type())
+	}
+	return match, nil
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+func TestCompileExpressionErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{name: "syntax error", expression: `repo.name ==`},
+		{name: "unknown field", expression: `repo.stars_count > 1`},
+		{name: "undeclared variable", expression: `org.name == "example-org"`},
+		{name: "type mismatch", expression: `repo.stars == "10"`},
+		{name: "non-bool result", expression: `repo.name`},
+		{name: "non-bool number", expression: `repo.size + 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := compileExpression(tt.expression); err == nil {
+				t.Fatalf("compileExpression(%q) succeeded, want an error", tt.expression)
+			}
+		})
+	}
+}
+
+func TestEvalExpression(t *testing.T) {
+	t.Parallel()
+	repo := &github.Repository{
+		Owner:           &github.User{Login: github.String("example-org")},
+		Name:            github.String("api"),
+		Visibility:      github.String("internal"),
+		Fork:            github.Bool(false),
+		StargazersCount: github.Int(3),
+		Topics:          []string{"service", "mirror"},
+		PushedAt:        &github.Timestamp{Time: time.Now().Add(-48 * time.Hour)},
+		CustomProperties: map[string]string{
+			"tier": "critical",
+		},
+	}
+	tests := []struct {
+		name       string
+		expression string
+		repo       *github.Repository
+		want       bool
+	}{
+		{name: "field", expression: `repo.owner == "example-org" && repo.name == "api"`, repo: repo, want: true},
+		{name: "topic present", expression: `"mirror" in repo.topics`, repo: repo, want: true},
+		{name: "topic missing", expression: `"experimental" in repo.topics`, repo: repo, want: false},
+		{name: "no topics", expression: `repo.topics.size() == 0`, repo: &github.Repository{}, want: true},
+		{name: "custom property", expression: `repo.custom_properties["tier"] == "critical"`, repo: repo, want: true},
+		{name: "custom property missing", expression: `"owner" in repo.custom_properties`, repo: repo, want: false},
+		{name: "no custom properties", expression: `repo.custom_properties.size() == 0`, repo: &github.Repository{}, want: true},
+		{name: "pushed within", expression: `now - repo.pushed_at < duration("72h")`, repo: repo, want: true},
+		{name: "not pushed within", expression: `now - repo.pushed_at < duration("24h")`, repo: repo, want: false},
+		{name: "pushed after timestamp", expression: `repo.pushed_at > timestamp("2020-01-01T00:00:00Z")`, repo: repo, want: true},
+		{name: "visibility", expression: `repo.visibility != "private" && !repo.fork`, repo: repo, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			expression, err := compileExpression(tt.expression)
+			if err != nil {
+				t.Fatalf("compileExpression(%q) failed: %v", tt.expression, err)
+			}
+			got, err := evalExpression(expression, tt.repo)
+			if err != nil {
+				t.Fatalf("evalExpression(%q) failed: %v", tt.expression, err)
+			}
+			if got != tt.want {
+				t.Errorf("evalExpression(%q) = %v, want %v", tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpressionUsesCustomProperties(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{expression: `repo.custom_properties["tier"] == "critical"`, want: true},
+		{expression: `has(repo.custom_properties.tier)`, want: true},
+		{expression: `repo.name == "custom_properties"`, want: false},
+		{expression: `{"custom_properties": true}.custom_properties`, want: false},
+		{expression: `"mirror" in repo.topics`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			t.Parallel()
+			filter := FilterConfig{Expression: tt.expression}
+			if err := filter.Compile(); err != nil {
+				t.Fatalf("Compile() failed: %v", err)
+			}
+			if got := filter.UsesCustomProperties(); got != tt.want {
+				t.Errorf("UsesCustomProperties() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// PatternSyntax is the syntax of the include and exclude patterns
+type PatternSyntax string
+
+var (
+	Regex PatternSyntax = "regex"
+	Glob  PatternSyntax = "glob"
+)
+
+// FilterConfig is the configuration for filtering repositories
+type FilterConfig struct {
+	// Include is a list of patterns to include
+	Include []string `json:"include"`
+	// Exclude is a list of patterns to exclude
+	Exclude []string `json:"exclude"`
+
+	// Syntax is the syntax of the Include and Exclude patterns, either regex (the default) or glob.
+	// Glob patterns always match the entire repository name.
+	Syntax PatternSyntax `json:"syntax"`
+	// FullMatch anchors regular expressions so they must match the entire repository name
+	FullMatch bool `json:"full-match"`
+
+	// OnlyArchived is a flag to only include archived repositories
+	OnlyArchived bool `json:"only-archived"`
+
+	// ExcludeForks is a flag to skip forked repositories
+	ExcludeForks bool `json:"exclude-forks"`
+	// OnlyForks is a flag to only include forked repositories
+	OnlyForks bool `json:"only-forks"`
+
+	// Visibility is a list of visibilities to include: public, private, or internal
+	Visibility []string `json:"visibility"`
+	// Languages is a list of primary languages to include, compared case-insensitively
+	Languages []string `json:"languages"`
+
+	// Topics is a list of topics a repository must have, all of which are required
+	Topics []string `json:"topics"`
+	// ExcludeTopics is a list of topics a repository must not have
+	ExcludeTopics []string `json:"exclude-topics"`
+
+	// MaxSize is the maximum repository size in kilobytes, as reported by GitHub
+	MaxSize int `json:"max-size"`
+	// MinStars is the minimum number of stargazers
+	MinStars int `json:"min-stars"`
+
+	// PushedWithin only includes repositories pushed to within this duration
+	PushedWithin Duration `json:"pushed-within"`
+	// NotPushedSince only includes repositories that have not been pushed to within this duration
+	NotPushedSince Duration `json:"not-pushed-since"`
+
+	// CustomProperties is a map of GitHub custom property names to the value each must have.
+	// Only organization repositories have custom properties. Multi-select values are joined with commas.
+	CustomProperties map[string]string `json:"custom-properties"`
+
+	// Expression is an optional CEL expression evaluated against the repository as `repo`, with
+	// the current time as `now`.
+	// Repositories are only included when it evaluates to true.
+	Expression string `json:"expression"`
+
+	// compiled is set once Compile succeeds. Matching an uncompiled filter matches nothing,
+	// rather than ignoring patterns that were never compiled.
+	compiled   bool
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+	expression *compiledExpression
+}
+
+// Compile validates the filter and compiles the inclusion and exclusion patterns.
+// It must be called before matching, which otherwise matches nothing.
+func (f *FilterConfig) Compile() error {
+	if f.ExcludeForks && f.OnlyForks {
+		return fmt.Errorf("exclude-forks and only-forks are mutually exclusive")
+	}
+	for _, visibility := range f.Visibility {
+		switch strings.ToLower(visibility) {
+		case "public", "private", "internal":
+		default:
+			return fmt.Errorf("unknown visibility %q", visibility)
+		}
+	}
+	if f.MaxSize < 0 {
+		return fmt.Errorf("max-size must not be negative")
+	}
+	if f.MinStars < 0 {
+		return fmt.Errorf("min-stars must not be negative")
+	}
+	if f.PushedWithin < 0 || f.NotPushedSince < 0 {
+		return fmt.Errorf("pushed durations must not be negative")
+	}
+
+	var err error
+	f.include, err = f.compilePatterns(f.Include)
+	if err != nil {
+		return fmt.Errorf("invalid include pattern: %w", err)
+	}
+	f.exclude, err = f.compilePatterns(f.Exclude)
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+	if f.Expression != "" {
+		f.expression, err = compileExpression(f.Expression)
+		if err != nil {
+			return fmt.Errorf("invalid expression: %w", err)
+		}
+	}
+	f.compiled = true
+	return nil
+}
+
+func (f *FilterConfig) compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		var expr string
+		switch PatternSyntax(strings.ToLower(string(f.Syntax))) {
+		case "", Regex:
+			expr = pattern
+			if f.FullMatch {
+				expr = "^(?:" + pattern + ")$"
+			}
+		case Glob:
+			var err error
+			expr, err = globToRegexp(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%q: %w", pattern, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown pattern syntax %q", f.Syntax)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// globToRegexp converts a glob pattern into an anchored regular expression.
+// It supports *, ?, character classes such as [a-z] or [!0-9], and \ escapes.
+func globToRegexp(glob string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i+1 == len(runes) {
+				return "", fmt.Errorf("trailing escape character")
+			}
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			end := i + 1
+			if end < len(runes) && (runes[end] == '!' || runes[end] == '^') {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			class := runes[i+1 : end]
+			sb.WriteString("[")
+			if class[0] == '!' {
+				sb.WriteString("^")
+				class = class[1:]
+			}
+			sb.WriteString(strings.ReplaceAll(string(class), `\`, `\\`))
+			sb.WriteString("]")
+			i = end
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String(), nil
+}
+
+// MatchInclusion returns true if the name matches any of the inclusion patterns. It returns
+// false if the filter was not compiled.
+func (f FilterConfig) MatchInclusion(name string) bool {
+	if !f.compiled {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchExclusion returns true if the name matches any of the exclusion patterns. It returns
+// true if the filter was not compiled.
+func (f FilterConfig) MatchExclusion(name string) bool {
+	if !f.compiled {
+		return true
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the repository passes every configured filter
+func (f FilterConfig) Match(repo *github.Repository) bool {
+	name := repo.GetName()
+	if !f.MatchInclusion(name) || f.MatchExclusion(name) {
+		return false
+	}
+	if f.OnlyArchived && !repo.GetArchived() {
+		return false
+	}
+	if (f.ExcludeForks && repo.GetFork()) || (f.OnlyForks && !repo.GetFork()) {
+		return false
+	}
+	if len(f.Visibility) > 0 && !slices.ContainsFunc(f.Visibility, func(v string) bool {
+		return strings.EqualFold(v, RepositoryVisibility(repo))
+	}) {
+		return false
+	}
+	if len(f.Languages) > 0 && !slices.ContainsFunc(f.Languages, func(l string) bool {
+		return strings.EqualFold(l, repo.GetLanguage())
+	}) {
+		return false
+	}
+	for _, topic := range f.Topics {
+		if !slices.Contains(repo.Topics, strings.ToLower(topic)) {
+			return false
+		}
+	}
+	for _, topic := range f.ExcludeTopics {
+		if slices.Contains(repo.Topics, strings.ToLower(topic)) {
+			return false
+		}
+	}
+	if f.MaxSize > 0 && repo.GetSize() > f.MaxSize {
+		return false
+	}
+	if f.MinStars > 0 && repo.GetStargazersCount() < f.MinStars {
+		return false
+	}
+	pushedAt := repo.GetPushedAt().Time
+	if f.PushedWithin > 0 && time.Since(pushedAt) > time.Duration(f.PushedWithin) {
+		return false
+	}
+	if f.NotPushedSince > 0 && time.Since(pushedAt) < time.Duration(f.NotPushedSince) {
+		return false
+	}
+	for property, value := range f.CustomProperties {
+		if actual, ok := repo.CustomProperties[property]; !ok || actual != value {
+			return false
+		}
+	}
+	if f.expression != nil {
+		match, err := evalExpression(f.expression, repo)
+		if err != nil {
+			slog.Warn("Error evaluating filter expression", "repository", name, "error", err)
+			return false
+		}
+		return match
+	}
+	return true
+}
+
+// UsesCustomProperties returns true if matching requires the repository's custom property values
+func (f FilterConfig) UsesCustomProperties() bool {
+	return len(f.CustomProperties) > 0 || (f.expression != nil && f.expression.usesCustomProperties)
+}
+
+// RepositoryVisibility returns the visibility of the repository, falling back
+// to the private flag when GitHub does not report a visibility
+func RepositoryVisibility(repo *github.Repository) string {
+	if visibility := repo.GetVisibility(); visibility != "" {
+		return strings.ToLower(visibility)
+	}
+	if repo.GetPrivate() {
+		return "private"
+	}
+	return "public"
+}
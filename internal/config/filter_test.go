@@ -0,0 +1,38 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v62/github"
+)
+
+func TestFilterMatchCompiled(t *testing.T) {
+	t.Parallel()
+	repo := &github.Repository{Name: github.String("api")}
+	tests := []struct {
+		name    string
+		filter  FilterConfig
+		compile bool
+		want    bool
+	}{
+		{name: "uncompiled empty filter", filter: FilterConfig{}, want: false},
+		{name: "uncompiled include", filter: FilterConfig{Include: []string{"^api$"}}, want: false},
+		{name: "compiled empty filter", filter: FilterConfig{}, compile: true, want: true},
+		{name: "compiled include", filter: FilterConfig{Include: []string{"^api$"}}, compile: true, want: true},
+		{name: "compiled exclude", filter: FilterConfig{Exclude: []string{"^api$"}}, compile: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			filter := tt.filter
+			if tt.compile {
+				if err := filter.Compile(); err != nil {
+					t.Fatalf("Compile() failed: %v", err)
+				}
+			}
+			if got := filter.Match(repo); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-github/v62/github"
+)
+
+// ReplaceConfig is a regular expression replacement applied to a rendered name
+type ReplaceConfig struct {
+	// Pattern is the regular expression to match
+	Pattern string `json:"pattern"`
+	// Replacement is the replacement text, which may reference capture groups such as $1
+	Replacement string `json:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// NameData is the data available to owner and repository name templates
+type NameData struct {
+	// Owner is the GitHub owner of the source repository
+	Owner string
+	// Name is the GitHub name of the source repository
+	Name string
+	// Topics are the GitHub topics of the source repository
+	Topics []string
+	// Visibility is the visibility of the source repository: public, private, or internal
+	Visibility string
+}
+
+//nolint:golint,gochecknoglobals
+var nameFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"join":       strings.Join,
+}
+
+// Compile parses the owner and repository name templates and replacement patterns.
+// It must be called before rendering names.
+func (t *MirrorToEntityConfig) Compile() error {
+	var err error
+	t.ownerTemplate, err = template.New("owner").Funcs(nameFuncs).Parse(t.Name)
+	if err != nil {
+		return fmt.Errorf("invalid owner template: %w", err)
+	}
+	repoTemplate := t.Repo
+	if repoTemplate == "" {
+		repoTemplate = "{{.Name}}"
+	}
+	t.repoTemplate, err = template.New("repo").Funcs(nameFuncs).Parse(repoTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid repo template: %w", err)
+	}
+	for i := range t.OwnerReplace {
+		t.OwnerReplace[i].re, err = regexp.Compile(t.OwnerReplace[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid owner replacement pattern %q: %w", t.OwnerReplace[i].Pattern, err)
+		}
+	}
+	for i := range t.RepoReplace {
+		t.RepoReplace[i].re, err = regexp.Compile(t.RepoReplace[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid repo replacement pattern %q: %w", t.RepoReplace[i].Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Target returns the Gitea owner and repository name a GitHub repository is mirrored to
+func (m MirrorConfig) Target(repo *github.Repository) (string, string, error) {
+	data := NameData{
+		Owner:      repo.GetOwner().GetLogin(),
+		Name:       repo.GetName(),
+		Topics:     repo.Topics,
+		Visibility: RepositoryVisibility(repo),
+	}
+	if data.Owner == "" {
+		data.Owner = m.From.Name
+	}
+
+	owner, err := renderName(m.To.ownerTemplate, m.To.OwnerReplace, data)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to render owner: %w", err)
+	}
+	name, err := renderName(m.To.repoTemplate, m.To.RepoReplace, data)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to render repo name: %w", err)
+	}
+	name = m.Prefix + name + m.Suffix
+
+	if owner == "" {
+		return "", "", fmt.Errorf("rendered owner is empty")
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("rendered repo name is empty")
+	}
+	if !validName.MatchString(owner) {
+		return "", "", fmt.Errorf("rendered owner %q is not a valid name", owner)
+	}
+	if !validName.MatchString(name) {
+		return "", "", fmt.Errorf("rendered repo name %q is not a valid name", name)
+	}
+	return owner, name, nil
+}
+
+// validName matches the owner and repository names both Gitea and GitHub accept
+//
+//nolint:golint,gochecknoglobals
+var validName = regexp.MustCompile(`^[-_.a-zA-Z0-9]+$`)
+
+// CheckTarget renders the mirror's target for a sample repository, so templates that fail to
+// execute or render an empty or invalid name are found before any repository is mirrored
+func (m MirrorConfig) CheckTarget() error {
+	_, _, err := m.Target(&github.Repository{
+		Owner:      &github.User{Login: github.String(m.From.Name)},
+		Name:       github.String("example"),
+		Topics:     []string{"example"},
+		Visibility: github.String("public"),
+	})
+	return err
+}
+
+func renderName(tmpl *template.Template, replacements []ReplaceConfig, data NameData) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(sb.String())
+	for _, replacement := range replacements {
+		name = replacement.re.ReplaceAllString(name, replacement.Replacement)
+	}
+	return name, nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestCheckTarget(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		owner   string
+		repo    string
+		wantErr bool
+	}{
+		{name: "defaults", owner: "example-org"},
+		{name: "templates", owner: "{{lower .Owner}}", repo: "{{.Visibility}}-{{.Name}}"},
+		{name: "missing field", owner: "example-org", repo: "{{.Missing}}", wantErr: true},
+		{name: "empty owner", owner: "{{if false}}example-org{{end}}", wantErr: true},
+		{name: "empty repo", owner: "example-org", repo: " ", wantErr: true},
+		{name: "invalid repo", owner: "example-org", repo: "{{.Owner}}/{{.Name}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mirror := MirrorConfig{
+				From: MirrorFromEntityConfig{Name: "Example-Org"},
+				To:   MirrorToEntityConfig{Name: tt.owner, Repo: tt.repo},
+			}
+			if err := mirror.To.Compile(); err != nil {
+				t.Fatalf("Compile() failed: %v", err)
+			}
+			if err := mirror.CheckTarget(); (err != nil) != tt.wantErr {
+				t.Fatalf("CheckTarget() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
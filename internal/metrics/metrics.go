@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "gitea_mirror"
+
+// Results of mirroring a repository, for ReposTotal
+const (
+	ResultCreated = "created"
+	ResultSkipped = "skipped"
+	ResultFailed  = "failed"
+)
+
+//nolint:golint,gochecknoglobals
+var (
+	// ReposListed is the number of repositories listed by each mirror in the last pass. Mirrors
+	// are labelled by their index in the config, since several can share a source.
+	ReposListed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "source_repos",
+		Help:      "Number of repositories listed from the source in the last pass",
+	}, []string{"mirror", "direction", "source"})
+
+	// ReposTotal counts the repositories mirrored by each mirror by result
+	ReposTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "repos_total",
+		Help:      "Repositories mirrored by result: created, skipped, or failed",
+	}, []string{"mirror", "direction", "source", "result"})
+
+	// ReconcileChanges counts the changes made to existing Gitea repositories by kind
+	ReconcileChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_changes_total",
+		Help:      "Changes made while reconciling repositories, by kind",
+	}, []string{"kind"})
+
+	// PassDuration is how long each mirroring pass took
+	PassDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pass_duration_seconds",
+		Help:      "Duration of mirroring passes",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	})
+
+	// LastSuccess is when each mirror last completed a pass in which its source was listed and
+	// every repository mirrored and synced without errors
+	LastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time the mirror last completed a pass without any errors",
+	}, []string{"mirror", "direction", "source"})
+
+	// GitHubRateLimitRemaining is the GitHub API rate limit remaining by resource
+	GitHubRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "GitHub API requests remaining in the current rate limit window",
+	}, []string{"resource"})
+
+	// SidecarRotations counts the tokens the sidecar wrote or served by mode
+	SidecarRotations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sidecar_rotations_total",
+		Help:      "Installation tokens written or served by the sidecar",
+	}, []string{"mode"})
+
+	// SidecarRotationFailures counts the tokens the sidecar failed to write or serve by mode
+	SidecarRotationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sidecar_rotation_failures_total",
+		Help:      "Installation tokens the sidecar failed to write or serve",
+	}, []string{"mode"})
+)
+
+// RateLimitTransport records the GitHub rate limit headers of every response
+type RateLimitTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		resource := resp.Header.Get("X-RateLimit-Resource")
+		if resource == "" {
+			resource = "core"
+		}
+		GitHubRateLimitRemaining.WithLabelValues(resource).Set(float64(remaining))
+	}
+	return resp, nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"code.gitea.io/sdk/gitea"
 	"github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/gofri/go-github-ratelimit/github_ratelimit"
 	"github.com/google/go-github/v62/github"
@@ -16,7 +17,7 @@ func authenticate(config *config.Config) (*github.Client, *github.Client, *gitea
 	var githubAppClient *github.Client
 	var giteaClient *gitea.Client
 
-	rateLimiter, err := github_ratelimit.NewRateLimitWaiterClient(nil)
+	rateLimiter, err := github_ratelimit.NewRateLimitWaiterClient(&metrics.RateLimitTransport{})
 	if err != nil {
 		return nil, nil, nil, err
 	}
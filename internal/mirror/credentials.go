@@ -0,0 +1,207 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	git "github.com/go-git/go-git/v5"
+)
+
+// credentialRequestLimit bounds the size of a git credential request
+const credentialRequestLimit = 64 * 1024
+
+// runCredentialSidecar serves installation tokens to git over HTTP, so tokens are minted when
+// git needs them and never have to be written into the repositories' git config
+func (m *Mirror) runCredentialSidecar() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /git-credential", m.handleGitCredential)
+	server := m.startSidecarServer(mux)
+
+	var installationOwner string
+	reposChan := make(chan string)
+	// done is closed when the sidecar stops, so walks stop sending to reposChan
+	done := make(chan struct{})
+	defer close(done)
+	strip := time.NewTimer(0)
+	if !m.config.SidecarStripTokens {
+		strip.Stop()
+	}
+	defer strip.Stop()
+	for {
+		select {
+		case <-m.stopChan:
+			stopSidecarServer(server)
+			slog.Info("Sidecar stopped")
+			m.didSidecarStopChan <- struct{}{}
+			return
+		case repo := <-reposChan:
+			m.stripRepo(repo, installationOwner)
+		case <-strip.C:
+			// Only beats when stripping, since the loop is otherwise idle until stopped
+			m.sidecarBeat.beat()
+			if m.config.SidecarOwnedOnly && installationOwner == "" {
+				githubAppClient, err := m.getGitHubAppClient()
+				if err == nil {
+					installationOwner, err = getInstallationOwner(githubAppClient, int64(m.config.GitHubAuth.InstallationID))
+				}
+				if err != nil {
+					slog.Error("Error getting installation", "error", err)
+					strip.Reset(time.Minute)
+					continue
+				}
+			}
+			// Repeated to catch mirrors created since, which Gitea gives an embedded token
+			go findRepos(m.config.GiteaAuth.RepoRoots(), reposChan, done)
+			strip.Reset(time.Hour)
+		}
+	}
+}
+
+// handleGitCredential answers a git credential helper "get" request. The body is the
+// key=value lines git writes to a credential helper, and the response is the lines the helper
+// should print. Requests for hosts other than GitHub get an empty response, so git moves on
+// to its next helper.
+func (m *Mirror) handleGitCredential(w http.ResponseWriter, r *http.Request) {
+	request, err := parseCredentialRequest(http.MaxBytesReader(w, r.Body, credentialRequestLimit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remoteURL := &url.URL{Scheme: request["protocol"], Host: request["host"], Path: "/" + request["path"]}
+	if !m.isGitHubURL(remoteURL.String()) {
+		return
+	}
+
+	githubAppClient, err := m.getGitHubAppClient()
+	if err != nil {
+		slog.Error("Error authenticating", "error", err)
+		http.Error(w, "failed to authenticate", http.StatusServiceUnavailable)
+		return
+	}
+
+	var token installationToken
+	var reason string
+	switch {
+	case request["path"] != "":
+		token, reason, err = m.remoteInstallationToken(githubAppClient, remoteURL, m.credentialAccess())
+	case m.config.GetTokenScope() == configPkg.TokenScopeInstallation:
+		token.token, token.expiresAt, err = installationTokens.get(githubAppClient, newTokenScope(m.config, int64(m.config.GitHubAuth.InstallationID), "", ""))
+	default:
+		// Without it git leaves out the repository, which repository scoped tokens need
+		reason = "credential.useHttpPath is not enabled"
+	}
+	if err != nil {
+		slog.Error("Error creating installation token", "host", request["host"], "path", request["path"], "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarCredentials)).Inc()
+		http.Error(w, "failed to create installation token", http.StatusBadGateway)
+		return
+	}
+	if reason != "" {
+		slog.Info("Not serving credentials", "host", request["host"], "path", request["path"], "reason", reason)
+		return
+	}
+	metrics.SidecarRotations.WithLabelValues(string(configPkg.SidecarCredentials)).Inc()
+	fmt.Fprintf(w, "username=x-access-token\npassword=%s\npassword_expiry_utc=%d\n", token.token, token.expiresAt.Unix())
+}
+
+// credentialAccess returns the access tokens served to git need. Git does not say whether it
+// is fetching or pushing, so tokens can push when any mirror pushes to GitHub.
+func (m *Mirror) credentialAccess() tokenAccess {
+	for _, mirror := range m.config.Mirrors {
+		if mirror.IsPush() {
+			return accessPush
+		}
+	}
+	return accessFetch
+}
+
+// startSidecarServer serves the handler on the sidecar listen address in the background
+func (m *Mirror) startSidecarServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              m.config.GetSidecarListen(),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("Sidecar listening", "address", server.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving sidecar", "error", err)
+		}
+	}()
+	return server
+}
+
+// stopSidecarServer stops the server, giving requests in flight time to finish
+func stopSidecarServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error stopping sidecar server", "error", err)
+	}
+}
+
+// parseCredentialRequest reads git credential helper key=value lines, up to a blank line
+func parseCredentialRequest(body io.Reader) (map[string]string, error) {
+	request := make(map[string]string)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid credential line %q", line)
+		}
+		request[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credential request: %w", err)
+	}
+	return request, nil
+}
+
+// stripRepo removes the credentials embedded in the GitHub remotes of a repository, so git
+// asks its credential helper instead of using a stale token. If installationOwner is set, only
+// remotes of repositories it owns are changed.
+func (m *Mirror) stripRepo(repo, installationOwner string) {
+	gitRepo, err := git.PlainOpen(repo)
+	if err != nil {
+		slog.Error("Error opening repo", "error", err)
+		return
+	}
+	remotes, err := gitRepo.Remotes()
+	if err != nil {
+		slog.Error("Error listing remotes", "repo", repo, "error", err)
+		return
+	}
+	for _, remote := range remotes {
+		remoteConfig := remote.Config()
+		if len(remoteConfig.URLs) == 0 {
+			continue
+		}
+		if remoteConfig.Name != "origin" && !strings.HasPrefix(remoteConfig.Name, pushMirrorRemotePrefix) {
+			continue
+		}
+		properURL, reason := m.rotatableRemote(remoteConfig.URLs[0], installationOwner)
+		if reason != "" {
+			continue
+		}
+		properURL.User = nil
+		if err := rewriteRemoteURL(repo, remoteConfig.Name, properURL.String()); err != nil {
+			slog.Error("Error updating remote URL", "repo", repo, "remote", remoteConfig.Name, "error", err)
+			continue
+		}
+		slog.Info("Removed token from remote", "repo", repo, "remote", remoteConfig.Name)
+	}
+}
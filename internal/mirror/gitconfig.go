@@ -0,0 +1,135 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errRemoteURLNotFound is returned when the git config has no url for the remote
+var errRemoteURLNotFound = errors.New("remote url not found")
+
+// rewriteRemoteURL replaces the url of a remote in a repository's git config, leaving every
+// other byte of the config untouched. Like git, it takes config.lock with O_EXCL, writes the
+// new config there, and renames it over the config, so git and Gitea never see a partial
+// config and concurrent writers back off rather than losing each other's changes.
+func rewriteRemoteURL(repo, remote, newURL string) error {
+	configPath := filepath.Join(repo, "config")
+	if _, err := os.Stat(configPath); errors.Is(err, os.ErrNotExist) {
+		// Not a bare repository
+		configPath = filepath.Join(repo, ".git", "config")
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat git config: %w", err)
+	}
+	lockPath := configPath + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("git config is locked by another process: %w", err)
+		}
+		return fmt.Errorf("failed to lock git config: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			lock.Close()
+			os.Remove(lockPath)
+		}
+	}()
+
+	// Read the config only once it is locked, so no other writer's change is lost
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read git config: %w", err)
+	}
+	updated, err := replaceRemoteURL(string(data), remote, newURL)
+	if err != nil {
+		return err
+	}
+
+	if _, err := lock.WriteString(updated); err != nil {
+		return fmt.Errorf("failed to write git config: %w", err)
+	}
+	if err := lock.Sync(); err != nil {
+		return fmt.Errorf("failed to sync git config: %w", err)
+	}
+	if err := lock.Close(); err != nil {
+		return fmt.Errorf("failed to close git config: %w", err)
+	}
+	if err := os.Rename(lockPath, configPath); err != nil {
+		return fmt.Errorf("failed to replace git config: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+// replaceRemoteURL replaces the value of the first url key in the remote's section of a git
+// config, keeping the key, its indentation, and the line ending as they were
+func replaceRemoteURL(config, remote, newURL string) (string, error) {
+	lines := strings.SplitAfter(config, "\n")
+	inRemote := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section, subsection, ok := parseSectionHeader(trimmed)
+			inRemote = ok && strings.EqualFold(section, "remote") && subsection == remote
+			continue
+		}
+		if !inRemote {
+			continue
+		}
+
+		body := strings.TrimRight(line, "\r\n")
+		ending := line[len(body):]
+		indent := body[:len(body)-len(strings.TrimLeft(body, " \t"))]
+		key, value, ok := strings.Cut(body[len(indent):], "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "url") {
+			continue
+		}
+		separator := key + "=" + value[:len(value)-len(strings.TrimLeft(value, " \t"))]
+		lines[i] = indent + separator + quoteConfigValue(newURL) + ending
+		return strings.Join(lines, ""), nil
+	}
+	return "", fmt.Errorf("%w: %s", errRemoteURLNotFound, remote)
+}
+
+// parseSectionHeader parses a git config section header, either [section "subsection"] or
+// the deprecated [section.subsection]
+func parseSectionHeader(header string) (string, string, bool) {
+	end := strings.LastIndex(header, "]")
+	if !strings.HasPrefix(header, "[") || end < 0 {
+		return "", "", false
+	}
+	inner := header[1:end]
+	section, subsection, found := strings.Cut(inner, " ")
+	if !found {
+		section, subsection, _ = strings.Cut(inner, ".")
+		return section, strings.ToLower(subsection), true
+	}
+	subsection = strings.TrimSpace(subsection)
+	if len(subsection) < 2 || subsection[0] != '"' || subsection[len(subsection)-1] != '"' {
+		return "", "", false
+	}
+	var unquoted strings.Builder
+	for i := 1; i < len(subsection)-1; i++ {
+		if subsection[i] == '\\' && i+1 < len(subsection)-1 {
+			i++
+		}
+		unquoted.WriteByte(subsection[i])
+	}
+	return section, unquoted.String(), true
+}
+
+// quoteConfigValue quotes a git config value if it contains characters git would otherwise
+// treat as a comment, escape, or surrounding whitespace
+func quoteConfigValue(value string) string {
+	if !strings.ContainsAny(value, "#;\"\\") && strings.TrimSpace(value) == value {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,64 @@
+package mirror
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/USA-RedDragon/gitea-mirror/internal/config"
+)
+
+// giteaAPI calls Gitea API endpoints that the Gitea SDK does not cover
+type giteaAPI struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newGiteaAPI(config *config.Config) *giteaAPI {
+	return &giteaAPI{
+		baseURL: strings.TrimSuffix(config.GiteaAuth.URL, "/") + "/api/v1",
+		token:   config.GiteaAuth.Token,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// do sends a JSON request to the Gitea API and decodes the JSON response into out, if set
+func (g *giteaAPI) do(method, path string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, g.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+g.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
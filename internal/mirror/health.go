@@ -0,0 +1,90 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+)
+
+// authCheckTimeout bounds the requests made to check authentication, so a slow GitHub or
+// Gitea cannot hold up readiness probes
+const authCheckTimeout = 10 * time.Second
+
+// heartbeat records when a loop last made progress. A heartbeat that never beat belongs to a
+// loop that is not running, so it is not checked.
+type heartbeat struct {
+	last atomic.Int64
+}
+
+func (h *heartbeat) beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// stalled returns how long the loop has gone without progress, if that is over the threshold
+func (h *heartbeat) stalled(threshold time.Duration) (time.Duration, bool) {
+	last := h.last.Load()
+	if last == 0 {
+		return 0, false
+	}
+	since := time.Since(time.Unix(0, last))
+	return since, since > threshold
+}
+
+// Live returns an error if the scheduler or the sidecar loop has stalled past the threshold
+func (m *Mirror) Live() error {
+	threshold := m.config.GetHealthStallThreshold()
+	if since, stalled := m.schedulerBeat.stalled(threshold); stalled {
+		return fmt.Errorf("scheduler has not completed a pass in %s", since.Round(time.Second))
+	}
+	if since, stalled := m.sidecarBeat.stalled(threshold); stalled {
+		return fmt.Errorf("sidecar has not made progress in %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// Ready returns an error until authentication with GitHub and Gitea has succeeded once
+func (m *Mirror) Ready() error {
+	if m.authenticated.Load() {
+		return nil
+	}
+	// Probes arriving during a check wait for it rather than repeating it
+	m.authCheckMu.Lock()
+	defer m.authCheckMu.Unlock()
+	if m.authenticated.Load() {
+		return nil
+	}
+	if err := checkAuthentication(m.config); err != nil {
+		return err
+	}
+	m.authenticated.Store(true)
+	return nil
+}
+
+// checkAuthentication makes an authenticated request to GitHub and to Gitea, since creating
+// the clients does not contact either
+func checkAuthentication(config *configPkg.Config) error {
+	githubClient, githubAppClient, giteaClient, err := authenticate(config)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authCheckTimeout)
+	defer cancel()
+	if githubAppClient != nil {
+		_, _, err = githubAppClient.Apps.Get(ctx, "")
+	} else {
+		_, _, err = githubClient.Users.Get(ctx, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with GitHub: %w", err)
+	}
+
+	giteaClient.SetContext(ctx)
+	if _, _, err := giteaClient.GetMyUserInfo(); err != nil {
+		return fmt.Errorf("failed to authenticate with Gitea: %w", err)
+	}
+	return nil
+}
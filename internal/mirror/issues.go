@@ -0,0 +1,324 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/USA-RedDragon/gitea-mirror/internal/state"
+	"github.com/google/go-github/v62/github"
+)
+
+// issueSyncSkew is subtracted from the last sync time so updates racing a sync are not missed
+const issueSyncSkew = 5 * time.Minute
+
+// pullRequestLabel marks Gitea issues created for GitHub pull requests, since Gitea cannot
+// open pull requests on a pull mirror
+const pullRequestLabel = "pull-request"
+
+// issueSyncer incrementally syncs the issues, pull requests, comments, and labels of one repository
+type issueSyncer struct {
+	githubClient *github.Client
+	giteaClient  *gitea.Client
+	config       configPkg.IssueSyncConfig
+	state        *state.RepoState
+
+	githubOwner string
+	githubName  string
+	owner       string
+	name        string
+
+	// labels caches the Gitea label IDs of the repository by lowercased name
+	labels map[string]int64
+	// failed counts the issues and comments that failed to sync, which are retried next pass
+	failed int
+}
+
+// syncIssues brings issues, pull requests, comments, and labels that were created or updated
+// on GitHub since the last sync into the Gitea repository. baseline is the time the Gitea
+// repository was migrated, which is used when the repository has no sync state yet.
+func syncIssues(githubClient *github.Client, giteaClient *gitea.Client, config configPkg.IssueSyncConfig, repoState *state.RepoState, owner, name string, githubRepo *github.Repository, baseline time.Time) error {
+	if repoState.IssuesBaseline.IsZero() {
+		repoState.IssuesBaseline = baseline
+	}
+	syncer := &issueSyncer{
+		githubClient: githubClient,
+		giteaClient:  giteaClient,
+		config:       config,
+		state:        repoState,
+		githubOwner:  githubRepo.GetOwner().GetLogin(),
+		githubName:   githubRepo.GetName(),
+		owner:        owner,
+		name:         name,
+	}
+
+	since := repoState.IssuesSyncedAt
+	if since.IsZero() {
+		since = repoState.IssuesBaseline
+	}
+	since = since.Add(-issueSyncSkew)
+	started := time.Now()
+
+	if err := syncer.syncIssues(since); err != nil {
+		return err
+	}
+	if err := syncer.syncComments(since); err != nil {
+		return err
+	}
+	// Everything updated since the last complete sync is listed again until all of it syncs.
+	// Already synced issues and comments are matched through the state, so nothing is duplicated.
+	if syncer.failed > 0 {
+		return fmt.Errorf("%d issues or comments failed to sync, retrying next pass", syncer.failed)
+	}
+	repoState.IssuesSyncedAt = started
+	return nil
+}
+
+func (s *issueSyncer) syncIssues(since time.Time) error {
+	opt := &github.IssueListByRepoOptions{
+		State:       "all",
+		Sort:        "updated",
+		Direction:   "asc",
+		Since:       since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		issues, resp, err := s.githubClient.Issues.ListByRepo(context.Background(), s.githubOwner, s.githubName, opt)
+		if err != nil {
+			return fmt.Errorf("failed to list issues: %w", err)
+		}
+		for _, issue := range issues {
+			if issue.IsPullRequest() && !s.config.PullRequests {
+				continue
+			}
+			if err := s.syncIssue(issue); err != nil {
+				slog.Error("Error syncing issue", "repo", s.owner+"/"+s.name, "number", issue.GetNumber(), "error", err)
+				s.failed++
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *issueSyncer) syncIssue(issue *github.Issue) error {
+	labels, err := s.labelIDs(issue)
+	if err != nil {
+		return err
+	}
+
+	mapped, ok := s.state.Issues[issue.GetNumber()]
+	if !ok {
+		if !issue.GetCreatedAt().After(s.state.IssuesBaseline) {
+			// Imported by the migration, which keeps GitHub's numbering
+			mapped = state.IssueState{Index: int64(issue.GetNumber())}
+		} else {
+			slog.Info("Creating issue", "repo", s.owner+"/"+s.name, "number", issue.GetNumber())
+			created, _, err := s.giteaClient.CreateIssue(s.owner, s.name, gitea.CreateIssueOption{
+				Title:  issue.GetTitle(),
+				Body:   attributedBody(issue.GetUser().GetLogin(), issue.GetHTMLURL(), issue.GetBody()),
+				Labels: labels,
+				Closed: issue.GetState() == "closed",
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create issue: %w", err)
+			}
+			s.state.Issues[issue.GetNumber()] = state.IssueState{Index: created.Index, Created: true}
+			metrics.ReconcileChanges.WithLabelValues("issues").Inc()
+			return nil
+		}
+	}
+
+	existing, _, err := s.giteaClient.GetIssue(s.owner, s.name, mapped.Index)
+	if err != nil {
+		return fmt.Errorf("failed to get Gitea issue %d: %w", mapped.Index, err)
+	}
+	s.state.Issues[issue.GetNumber()] = mapped
+
+	body := issue.GetBody()
+	if mapped.Created {
+		body = attributedBody(issue.GetUser().GetLogin(), issue.GetHTMLURL(), body)
+	}
+	issueState := gitea.StateOpen
+	if issue.GetState() == "closed" {
+		issueState = gitea.StateClosed
+	}
+	if existing.Title != issue.GetTitle() || existing.Body != body || existing.State != issueState {
+		slog.Info("Updating issue", "repo", s.owner+"/"+s.name, "index", mapped.Index)
+		_, _, err := s.giteaClient.EditIssue(s.owner, s.name, mapped.Index, gitea.EditIssueOption{
+			Title: issue.GetTitle(),
+			Body:  &body,
+			State: &issueState,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update issue: %w", err)
+		}
+		metrics.ReconcileChanges.WithLabelValues("issues").Inc()
+	}
+
+	current := make([]int64, 0, len(existing.Labels))
+	for _, label := range existing.Labels {
+		current = append(current, label.ID)
+	}
+	slices.Sort(current)
+	if !slices.Equal(current, labels) {
+		_, _, err := s.giteaClient.ReplaceIssueLabels(s.owner, s.name, mapped.Index, gitea.IssueLabelsOption{Labels: labels})
+		if err != nil {
+			return fmt.Errorf("failed to update labels: %w", err)
+		}
+		metrics.ReconcileChanges.WithLabelValues("issues").Inc()
+	}
+	return nil
+}
+
+func (s *issueSyncer) syncComments(since time.Time) error {
+	opt := &github.IssueListCommentsOptions{
+		Sort:        github.String("updated"),
+		Direction:   github.String("asc"),
+		Since:       &since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		// Issue number 0 lists the comments of every issue in the repository
+		comments, resp, err := s.githubClient.Issues.ListComments(context.Background(), s.githubOwner, s.githubName, 0, opt)
+		if err != nil {
+			return fmt.Errorf("failed to list comments: %w", err)
+		}
+		for _, comment := range comments {
+			if err := s.syncComment(comment); err != nil {
+				slog.Error("Error syncing comment", "repo", s.owner+"/"+s.name, "comment", comment.GetID(), "error", err)
+				s.failed++
+			}
+		}
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *issueSyncer) syncComment(comment *github.IssueComment) error {
+	body := attributedBody(comment.GetUser().GetLogin(), comment.GetHTMLURL(), comment.GetBody())
+
+	if id, ok := s.state.Comments[comment.GetID()]; ok {
+		existing, _, err := s.giteaClient.GetIssueComment(s.owner, s.name, id)
+		if err != nil {
+			return fmt.Errorf("failed to get comment: %w", err)
+		}
+		if existing.Body == body {
+			return nil
+		}
+		if _, _, err := s.giteaClient.EditIssueComment(s.owner, s.name, id, gitea.EditIssueCommentOption{Body: body}); err != nil {
+			return fmt.Errorf("failed to update comment: %w", err)
+		}
+		metrics.ReconcileChanges.WithLabelValues("issues").Inc()
+		return nil
+	}
+	// Comments imported by the migration cannot be matched up, so they are left alone
+	if !comment.GetCreatedAt().After(s.state.IssuesBaseline) {
+		return nil
+	}
+
+	number, err := issueNumberFromURL(comment.GetIssueURL())
+	if err != nil {
+		return err
+	}
+	mapped, ok := s.state.Issues[number]
+	if !ok {
+		if s.config.PullRequests || !strings.Contains(comment.GetHTMLURL(), "/pull/") {
+			// The issue failed to sync, so the comment is retried along with it
+			return fmt.Errorf("issue %d is not synced", number)
+		}
+		// The comment belongs to a pull request, which is not synced
+		return nil
+	}
+
+	slog.Info("Creating comment", "repo", s.owner+"/"+s.name, "index", mapped.Index)
+	created, _, err := s.giteaClient.CreateIssueComment(s.owner, s.name, mapped.Index, gitea.CreateIssueCommentOption{Body: body})
+	if err != nil {
+		return fmt.Errorf("failed to create comment: %w", err)
+	}
+	s.state.Comments[comment.GetID()] = created.ID
+	metrics.ReconcileChanges.WithLabelValues("issues").Inc()
+	return nil
+}
+
+// labelIDs returns the sorted Gitea label IDs for the GitHub issue's labels, creating any
+// labels the Gitea repository is missing
+func (s *issueSyncer) labelIDs(issue *github.Issue) ([]int64, error) {
+	if s.labels == nil {
+		s.labels = make(map[string]int64)
+		opt := gitea.ListLabelsOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}}
+		for {
+			labels, resp, err := s.giteaClient.ListRepoLabels(s.owner, s.name, opt)
+			if err != nil {
+				s.labels = nil
+				return nil, fmt.Errorf("failed to list labels: %w", err)
+			}
+			for _, label := range labels {
+				s.labels[strings.ToLower(label.Name)] = label.ID
+			}
+			if resp.NextPage == 0 {
+				break
+			}
+			opt.Page = resp.NextPage
+		}
+	}
+
+	type label struct{ name, color, description string }
+	wanted := make([]label, 0, len(issue.Labels)+1)
+	for _, l := range issue.Labels {
+		wanted = append(wanted, label{l.GetName(), l.GetColor(), l.GetDescription()})
+	}
+	if issue.IsPullRequest() {
+		wanted = append(wanted, label{pullRequestLabel, "6e5494", "Pull request synced from GitHub"})
+	}
+
+	ids := make([]int64, 0, len(wanted))
+	for _, l := range wanted {
+		id, ok := s.labels[strings.ToLower(l.name)]
+		if !ok {
+			color := l.color
+			if len(color) != 6 {
+				color = "ededed"
+			}
+			created, _, err := s.giteaClient.CreateLabel(s.owner, s.name, gitea.CreateLabelOption{
+				Name:        l.name,
+				Color:       "#" + color,
+				Description: l.description,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create label %s: %w", l.name, err)
+			}
+			id = created.ID
+			s.labels[strings.ToLower(l.name)] = id
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// attributedBody prefixes a body with its GitHub author and a link back to GitHub, since
+// content created through the API is attributed to the token's user
+func attributedBody(author, htmlURL, body string) string {
+	return fmt.Sprintf("> Originally posted by @%s on GitHub: %s\n\n%s", author, htmlURL, body)
+}
+
+func issueNumberFromURL(issueURL string) (int, error) {
+	i := strings.LastIndex(issueURL, "/")
+	number, err := strconv.Atoi(issueURL[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid issue URL %q", issueURL)
+	}
+	return number, nil
+}
@@ -2,12 +2,21 @@ package mirror
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.gitea.io/sdk/gitea"
 	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/USA-RedDragon/gitea-mirror/internal/state"
 	"github.com/google/go-github/v62/github"
 )
 
@@ -16,6 +25,19 @@ type Mirror struct {
 	stopChan           chan struct{}
 	didSidecarStopChan chan struct{}
 	didRunStopChan     chan struct{}
+
+	githubAppClientMu sync.Mutex
+	githubAppClient   *github.Client
+
+	// runMu is held by the running pass, so passes never overlap and overwrite each other's
+	// sync state
+	runMu sync.Mutex
+
+	// authCheckMu serializes the authentication checks of readiness probes
+	authCheckMu   sync.Mutex
+	authenticated atomic.Bool
+	schedulerBeat heartbeat
+	sidecarBeat   heartbeat
 }
 
 func New(config *configPkg.Config) *Mirror {
@@ -50,16 +72,46 @@ func (m *Mirror) Stop() {
 }
 
 func (m *Mirror) RunSidecar() {
-	m.runSidecar()
+	switch m.config.GetSidecarMode() {
+	case configPkg.SidecarAPI:
+		m.runAPISidecar()
+	case configPkg.SidecarCredentials:
+		m.runCredentialSidecar()
+	case configPkg.SidecarProxy:
+		m.runProxySidecar()
+	default:
+		m.runSidecar()
+	}
+}
+
+// getGitHubAppClient returns the sidecar's GitHub App client, creating it on first use
+func (m *Mirror) getGitHubAppClient() (*github.Client, error) {
+	m.githubAppClientMu.Lock()
+	defer m.githubAppClientMu.Unlock()
+	if m.githubAppClient == nil {
+		_, githubAppClient, _, err := authenticate(m.config)
+		if err != nil {
+			return nil, err
+		}
+		m.githubAppClient = githubAppClient
+	}
+	return m.githubAppClient, nil
 }
 
 func (m *Mirror) RunUntilStopped() {
 	run := func() {
+		if !m.runMu.TryLock() {
+			slog.Warn("Previous pass is still running, skipping this one")
+			return
+		}
+		defer m.runMu.Unlock()
 		err := Run(m.config)
 		if err != nil {
 			slog.Error("Error running", "error", err)
 		}
+		m.schedulerBeat.beat()
 	}
+	m.schedulerBeat.beat()
 	go run()
 	for {
 		select {
@@ -84,9 +136,7 @@ func getPATUserRepos(client *github.Client, data chan *github.Repository, filter
 			return err
 		}
 		for _, repo := range repos {
-			if filter.MatchInclusion(*repo.Name) &&
-				!filter.MatchExclusion(*repo.Name) &&
-				(!filter.OnlyArchived || (filter.OnlyArchived && *repo.Archived)) {
+			if filter.Match(repo) {
 				data <- repo
 			}
 		}
@@ -108,9 +158,7 @@ func getAppUserRepos(client *github.Client, user string, data chan *github.Repos
 			return err
 		}
 		for _, repo := range repos {
-			if filter.MatchInclusion(*repo.Name) &&
-				!filter.MatchExclusion(*repo.Name) &&
-				(!filter.OnlyArchived || (filter.OnlyArchived && *repo.Archived)) {
+			if filter.Match(repo) {
 				data <- repo
 			}
 		}
@@ -121,7 +169,77 @@ func getAppUserRepos(client *github.Client, user string, data chan *github.Repos
 	}
 }
 
+// customPropertyValues is a repository's custom property values, as listed for its
+// organization. go-github decodes values as strings, which fails on multi-select properties,
+// so the values are decoded by customPropertyValue instead.
+type customPropertyValues struct {
+	RepositoryName string `json:"repository_name"`
+	Properties     []struct {
+		PropertyName string          `json:"property_name"`
+		Value        json.RawMessage `json:"value"`
+	} `json:"properties"`
+}
+
+// customPropertyValue returns a custom property value as a string. Multi-select values are
+// joined with commas. It returns false for unset values and values of unsupported types.
+func customPropertyValue(raw json.RawMessage) (string, bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", false, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, true, nil
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return "", false, fmt.Errorf("unsupported custom property value %s", raw)
+	}
+	return strings.Join(values, ","), true, nil
+}
+
+func getOrgCustomProperties(client *github.Client, org string) (map[string]map[string]string, error) {
+	properties := make(map[string]map[string]string)
+	for page := 1; ; {
+		req, err := client.NewRequest(http.MethodGet, fmt.Sprintf("orgs/%s/properties/values?per_page=100&page=%d", url.PathEscape(org), page), nil)
+		if err != nil {
+			return nil, err
+		}
+		var values []*customPropertyValues
+		resp, err := client.Do(context.Background(), req, &values)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			repoProperties := make(map[string]string, len(value.Properties))
+			for _, property := range value.Properties {
+				decoded, ok, err := customPropertyValue(property.Value)
+				if err != nil {
+					slog.Warn("Skipping custom property", "repository", org+"/"+value.RepositoryName, "property", property.PropertyName, "error", err)
+					continue
+				}
+				if ok {
+					repoProperties[property.PropertyName] = decoded
+				}
+			}
+			properties[value.RepositoryName] = repoProperties
+		}
+		if resp.NextPage == 0 {
+			return properties, nil
+		}
+		page = resp.NextPage
+	}
+}
+
 func getOrgRepos(client *github.Client, entity string, data chan *github.Repository, filter configPkg.FilterConfig) error {
+	var properties map[string]map[string]string
+	if filter.UsesCustomProperties() {
+		var err error
+		properties, err = getOrgCustomProperties(client, entity)
+		if err != nil {
+			return fmt.Errorf("failed to list custom properties: %w", err)
+		}
+	}
+
 	opt := &github.RepositoryListByOrgOptions{
 		ListOptions: github.ListOptions{PerPage: 100},
 	}
@@ -132,9 +250,10 @@ func getOrgRepos(client *github.Client, entity string, data chan *github.Reposit
 			return err
 		}
 		for _, repo := range repos {
-			if filter.MatchInclusion(*repo.Name) &&
-				!filter.MatchExclusion(*repo.Name) &&
-				(!filter.OnlyArchived || (filter.OnlyArchived && *repo.Archived)) {
+			if properties != nil && len(repo.CustomProperties) == 0 {
+				repo.CustomProperties = properties[repo.GetName()]
+			}
+			if filter.Match(repo) {
 				data <- repo
 			}
 		}
@@ -145,6 +264,63 @@ func getOrgRepos(client *github.Client, entity string, data chan *github.Reposit
 	}
 }
 
+// mirroringToken returns the GitHub token Gitea uses to mirror the repository, which is an
+// installation token for the access needed when authenticating as a GitHub App
+func mirroringToken(config *configPkg.Config, githubAppClient *github.Client, repository string, access tokenAccess) (string, error) {
+	if config.GitHubAuth.InstallationID == 0 {
+		return config.GitHubAuth.MirroringToken, nil
+	}
+	token, _, err := installationTokens.get(githubAppClient, newTokenScope(config, int64(config.GitHubAuth.InstallationID), repository, access))
+	return token, err
+}
+
+// migrateOptions returns the options Gitea migrates the GitHub repository with. Through the
+// proxy sidecar, Gitea mirrors the repository over plain git without credentials, which
+// leaves out issues, pull requests, and releases. The wiki is left out when it is mirrored
+// separately, since Gitea would never update its copy.
+func migrateOptions(config *configPkg.Config, githubAppClient *github.Client, owner, name string, githubRepo *github.Repository, wiki bool) (gitea.MigrateRepoOption, error) {
+	if config.SidecarProxyURL != "" {
+		cloneAddr, err := proxyCloneURL(config.SidecarProxyURL, githubRepo.GetCloneURL())
+		if err != nil {
+			return gitea.MigrateRepoOption{}, err
+		}
+		return gitea.MigrateRepoOption{
+			RepoName:       name,
+			RepoOwner:      owner,
+			Service:        gitea.GitServicePlain,
+			CloneAddr:      cloneAddr,
+			Private:        githubRepo.GetPrivate(),
+			Description:    githubRepo.GetDescription(),
+			Mirror:         true,
+			MirrorInterval: "10m",
+			LFS:            true,
+		}, nil
+	}
+
+	token, err := mirroringToken(config, githubAppClient, githubRepo.GetName(), accessMigrate)
+	if err != nil {
+		return gitea.MigrateRepoOption{}, err
+	}
+	return gitea.MigrateRepoOption{
+		RepoName:       name,
+		RepoOwner:      owner,
+		Service:        gitea.GitServiceGithub,
+		CloneAddr:      *githubRepo.CloneURL,
+		AuthToken:      token,
+		Private:        *githubRepo.Private,
+		Description:    *githubRepo.Description,
+		Wiki:           wiki,
+		Milestones:     true,
+		Labels:         true,
+		Issues:         true,
+		PullRequests:   true,
+		Releases:       true,
+		Mirror:         true,
+		MirrorInterval: "10m",
+		LFS:            true,
+	}, nil
+}
+
 func Run(config *configPkg.Config) error {
 	if len(config.Mirrors) == 0 {
 		slog.Error("No mirrors defined")
@@ -157,34 +333,87 @@ func Run(config *configPkg.Config) error {
 		return err
 	}
 
-	for _, mirror := range config.Mirrors {
+	var syncState *state.State
+	if config.StatePath != "" {
+		syncState, err = state.Load(config.StatePath)
+		if err != nil {
+			slog.Error("Error loading state", "error", err)
+			return err
+		}
+	}
+
+	// targets maps each lowercased Gitea owner/name to the GitHub repository mirrored there,
+	// so that two sources rendering to the same target are reported rather than merged
+	targets := make(map[string]string)
+
+	// ensuredOwners caches the result of creating missing Gitea organizations for this pass
+	ensuredOwners := make(map[string]error)
+	giteaAPI := newGiteaAPI(config)
+
+	started := time.Now()
+	defer func() {
+		metrics.PassDuration.Observe(time.Since(started).Seconds())
+	}()
+
+	for i, mirror := range config.Mirrors {
+		// Mirrors are told apart by index in metrics, since several can share a source
+		index := strconv.Itoa(i)
+		direction := string(configPkg.Pull)
+		if mirror.IsPush() {
+			direction = string(configPkg.Push)
+		}
+		// failed is set when any repository fails to mirror or sync, which keeps LastSuccess
+		// from advancing
+		failed := false
+		countRepo := func(result string) {
+			if result == metrics.ResultFailed {
+				failed = true
+			}
+			metrics.ReposTotal.WithLabelValues(index, direction, mirror.From.Name, result).Inc()
+		}
+
+		if mirror.IsPush() {
+			slog.Info("Push mirroring", "owner", mirror.From.Name)
+			if err := runPushMirror(config, index, mirror, githubClient, githubAppClient, giteaAPI, targets); err != nil {
+				slog.Error("Error push mirroring", "owner", mirror.From.Name, "error", err)
+				continue
+			}
+			metrics.LastSuccess.WithLabelValues(index, direction, mirror.From.Name).SetToCurrentTime()
+			continue
+		}
+
+		// mirrored maps each GitHub repository name to its Gitea repository
+		mirrored := make(map[string]repoTarget)
 		reposChannel := make(chan *github.Repository)
+		// listErr is set by the listing goroutine before it closes reposChannel
+		var listErr error
+		listed := 0
 		from := mirror.From
 		switch from.Type {
 		case configPkg.User:
 			slog.Info("Mirroring user", "user", from.Name)
 			go func() {
 				if config.GitHubAuth.Token != "" {
-					err := getPATUserRepos(githubClient, reposChannel, from.Filter)
+					listErr = getPATUserRepos(githubClient, reposChannel, from.Filter)
 					defer close(reposChannel)
-					if err != nil {
-						slog.Error("Error getting repos", "error", err)
+					if listErr != nil {
+						slog.Error("Error getting repos", "error", listErr)
 					}
 				} else {
-					err := getAppUserRepos(githubClient, from.Name, reposChannel, from.Filter)
+					listErr = getAppUserRepos(githubClient, from.Name, reposChannel, from.Filter)
 					defer close(reposChannel)
-					if err != nil {
-						slog.Error("Error getting repos", "error", err)
+					if listErr != nil {
+						slog.Error("Error getting repos", "error", listErr)
 					}
 				}
 			}()
 		case configPkg.Organization:
 			slog.Info("Mirroring org", "org", from.Name)
 			go func() {
-				err := getOrgRepos(githubClient, from.Name, reposChannel, from.Filter)
+				listErr = getOrgRepos(githubClient, from.Name, reposChannel, from.Filter)
 				defer close(reposChannel)
-				if err != nil {
-					slog.Error("Error getting repos", "error", err)
+				if listErr != nil {
+					slog.Error("Error getting repos", "error", listErr)
 				}
 			}()
 		default:
@@ -194,47 +423,123 @@ func Run(config *configPkg.Config) error {
 		}
 
 		for githubRepo := range reposChannel {
+			listed++
 			if githubRepo.Description == nil {
 				githubRepo.Description = new(string)
 			}
-			slog.Info("Mirroring", "repository", *githubRepo.Name)
-			foundRepo, _, err := giteaClient.GetRepo(mirror.To.Name, fmt.Sprintf("%s%s%s", mirror.Prefix, *githubRepo.Name, mirror.Suffix))
+			owner, name, err := mirror.Target(githubRepo)
+			if err != nil {
+				slog.Error("Error naming mirror", "repository", githubRepo.GetFullName(), "error", err)
+				countRepo(metrics.ResultFailed)
+				continue
+			}
+			target := strings.ToLower(owner + "/" + name)
+			if source, ok := targets[target]; ok && source != githubRepo.GetFullName() {
+				slog.Error("Mirror target collision, skipping", "repository", githubRepo.GetFullName(), "target", owner+"/"+name, "conflicts-with", source)
+				countRepo(metrics.ResultSkipped)
+				continue
+			}
+			targets[target] = githubRepo.GetFullName()
+
+			if mirror.To.CreateOrg {
+				err, ok := ensuredOwners[strings.ToLower(owner)]
+				if !ok {
+					err = ensureGiteaOrg(githubClient, giteaClient, giteaAPI, owner, githubRepo.GetOwner(), mirror.To.Visibility)
+					ensuredOwners[strings.ToLower(owner)] = err
+				}
+				if err != nil {
+					slog.Error("Error creating destination organization", "org", owner, "error", err)
+					countRepo(metrics.ResultFailed)
+					continue
+				}
+			}
+
+			slog.Info("Mirroring", "repository", *githubRepo.Name, "target", owner+"/"+name)
+			// migratedAt is when Gitea imported the repository, including its issues
+			migratedAt := time.Now()
+			foundRepo, _, err := giteaClient.GetRepo(owner, name)
+			// A wiki mirror from an earlier pass must not be reconciled as a repository
+			if err == nil && foundRepo != nil && strings.HasSuffix(strings.ToLower(foundRepo.OriginalURL), ".wiki.git") {
+				slog.Error("Mirror target is a wiki mirror, skipping", "repository", githubRepo.GetFullName(), "target", owner+"/"+name, "mirrors", foundRepo.OriginalURL)
+				countRepo(metrics.ResultSkipped)
+				continue
+			}
 			if err != nil || foundRepo == nil {
-				token := config.GitHubAuth.MirroringToken
-				if config.GitHubAuth.InstallationID != 0 {
-					installToken, _, err := githubAppClient.Apps.CreateInstallationToken(context.Background(), int64(config.GitHubAuth.InstallationID), &github.InstallationTokenOptions{})
-					if err != nil {
-						slog.Error("Error creating installation token", "error", err)
-						continue
-					}
-					token = installToken.GetToken()
+				options, err := migrateOptions(config, githubAppClient, owner, name, githubRepo, !mirror.Wiki.Enabled)
+				if err != nil {
+					slog.Error("Error preparing migration", "repo", *githubRepo.Name, "error", err)
+					countRepo(metrics.ResultFailed)
+					continue
 				}
-				_, _, err = giteaClient.MigrateRepo(gitea.MigrateRepoOption{
-					RepoName:       fmt.Sprintf("%s%s%s", mirror.Prefix, *githubRepo.Name, mirror.Suffix),
-					RepoOwner:      mirror.To.Name,
-					Service:        gitea.GitServiceGithub,
-					CloneAddr:      *githubRepo.CloneURL,
-					AuthToken:      token,
-					Private:        *githubRepo.Private,
-					Description:    *githubRepo.Description,
-					Wiki:           true,
-					Milestones:     true,
-					Labels:         true,
-					Issues:         true,
-					PullRequests:   true,
-					Releases:       true,
-					Mirror:         true,
-					MirrorInterval: "10m",
-					LFS:            true,
-				})
+				_, _, err = giteaClient.MigrateRepo(options)
 				if err != nil {
 					slog.Error("Error mirroring", "repo", *githubRepo.Name, "error", err)
+					countRepo(metrics.ResultFailed)
+					continue
 				}
 				slog.Info("Mirror complete")
+				countRepo(metrics.ResultCreated)
 			} else {
-				slog.Info("Repo already exists, skipping")
+				slog.Info("Repo already exists, reconciling")
+				countRepo(metrics.ResultSkipped)
+				migratedAt = foundRepo.Created
+			}
+			// Mirrors created through the proxy sidecar imported no issues
+			if config.SidecarProxyURL != "" && (foundRepo == nil || strings.HasPrefix(foundRepo.OriginalURL, strings.TrimSuffix(config.SidecarProxyURL, "/"))) {
+				migratedAt = time.Time{}
+			}
+
+			if mirror.Topics.Enabled {
+				if changed, err := syncTopics(giteaClient, mirror.Topics, owner, name, githubRepo); err != nil {
+					slog.Error("Error syncing topics", "repo", owner+"/"+name, "error", err)
+					failed = true
+				} else if changed {
+					metrics.ReconcileChanges.WithLabelValues("topics").Inc()
+				}
+			}
+
+			if mirror.Releases.Enabled {
+				if err := syncReleases(githubClient, giteaClient, mirror.Releases, owner, name, githubRepo); err != nil {
+					slog.Error("Error syncing releases", "repo", owner+"/"+name, "error", err)
+					failed = true
+				}
+			}
+
+			if mirror.Issues.Enabled {
+				repoState := syncState.Repo(strings.ToLower(owner + "/" + name))
+				if err := syncIssues(githubClient, giteaClient, mirror.Issues, repoState, owner, name, githubRepo, migratedAt); err != nil {
+					slog.Error("Error syncing issues", "repo", owner+"/"+name, "error", err)
+					failed = true
+				}
+				if err := syncState.Save(); err != nil {
+					slog.Error("Error saving state", "error", err)
+					failed = true
+				}
+			}
+
+			if mirror.Wiki.Enabled && githubRepo.GetHasWiki() {
+				if err := ensureWikiMirror(config, githubAppClient, giteaClient, mirror.Wiki, owner, name, githubRepo, targets); err != nil {
+					slog.Error("Error mirroring wiki", "repo", owner+"/"+name, "error", err)
+					failed = true
+				}
+			}
+
+			mirrored[githubRepo.GetName()] = repoTarget{Owner: owner, Name: name}
+		}
+
+		metrics.ReposListed.WithLabelValues(index, direction, from.Name).Set(float64(listed))
+
+		if mirror.Teams.Enabled {
+			slog.Info("Syncing teams", "org", from.Name)
+			if err := syncTeams(githubClient, giteaClient, mirror, mirrored); err != nil {
+				slog.Error("Error syncing teams", "org", from.Name, "error", err)
+				failed = true
 			}
 		}
+
+		if listErr == nil && !failed {
+			metrics.LastSuccess.WithLabelValues(index, direction, from.Name).SetToCurrentTime()
+		}
 	}
 
 	return nil
@@ -0,0 +1,36 @@
+package mirror
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCustomPropertyValue(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "string", raw: `"critical"`, want: "critical", wantOK: true},
+		{name: "multi-select", raw: `["web","api"]`, want: "web,api", wantOK: true},
+		{name: "empty multi-select", raw: `[]`, want: "", wantOK: true},
+		{name: "null", raw: `null`},
+		{name: "missing", raw: ``},
+		{name: "number", raw: `3`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, ok, err := customPropertyValue(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("customPropertyValue(%s) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("customPropertyValue(%s) = %q, %v, want %q, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package mirror
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/google/go-github/v62/github"
+)
+
+// maxAvatarSize bounds the size of an avatar copied from GitHub
+const maxAvatarSize = 5 << 20
+
+// avatarTimeout bounds how long downloading an avatar from GitHub can hold up a mirror pass
+const avatarTimeout = time.Minute
+
+// giteaProfile is the profile a new Gitea organization is created with
+type giteaProfile struct {
+	FullName    string
+	Description string
+	Website     string
+	Location    string
+	AvatarURL   string
+}
+
+// ensureGiteaOrg creates the Gitea organization owner if no user or organization by that
+// name exists, copying the profile of the GitHub account that owns the source repository
+func ensureGiteaOrg(githubClient *github.Client, giteaClient *gitea.Client, api *giteaAPI, owner string, source *github.User, visibility string) error {
+	_, resp, err := giteaClient.GetOrg(owner)
+	if err == nil {
+		return nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to get organization: %w", err)
+	}
+
+	// Users are also valid destinations, and share a namespace with organizations
+	_, resp, err = giteaClient.GetUserInfo(owner)
+	if err == nil {
+		return nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	profile, err := getGitHubProfile(githubClient, source)
+	if err != nil {
+		// The profile is cosmetic, so still create the organization without it
+		slog.Warn("Error getting GitHub profile", "owner", source.GetLogin(), "error", err)
+	}
+
+	if visibility == "" {
+		visibility = string(gitea.VisibleTypePublic)
+	}
+	slog.Info("Creating Gitea organization", "org", owner, "visibility", visibility)
+	_, _, err = giteaClient.CreateOrg(gitea.CreateOrgOption{
+		Name:        owner,
+		FullName:    profile.FullName,
+		Description: truncate(profile.Description, 255),
+		Website:     profile.Website,
+		Location:    profile.Location,
+		Visibility:  gitea.VisibleType(strings.ToLower(visibility)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	if profile.AvatarURL != "" {
+		if err := copyOrgAvatar(api, owner, profile.AvatarURL); err != nil {
+			slog.Warn("Error copying organization avatar", "org", owner, "error", err)
+		}
+	}
+	return nil
+}
+
+func getGitHubProfile(client *github.Client, source *github.User) (giteaProfile, error) {
+	login := source.GetLogin()
+	if login == "" {
+		return giteaProfile{}, fmt.Errorf("source repository has no owner")
+	}
+
+	var profile giteaProfile
+	if source.GetType() == "Organization" {
+		org, _, err := client.Organizations.Get(context.Background(), login)
+		if err != nil {
+			return giteaProfile{}, err
+		}
+		profile = giteaProfile{
+			FullName:    org.GetName(),
+			Description: org.GetDescription(),
+			Website:     org.GetBlog(),
+			Location:    org.GetLocation(),
+			AvatarURL:   org.GetAvatarURL(),
+		}
+	} else {
+		user, _, err := client.Users.Get(context.Background(), login)
+		if err != nil {
+			return giteaProfile{}, err
+		}
+		profile = giteaProfile{
+			FullName:    user.GetName(),
+			Description: user.GetBio(),
+			Website:     user.GetBlog(),
+			Location:    user.GetLocation(),
+			AvatarURL:   user.GetAvatarURL(),
+		}
+	}
+
+	// GitHub allows websites without a scheme, which Gitea rejects
+	if profile.Website != "" && !strings.Contains(profile.Website, "://") {
+		profile.Website = "https://" + profile.Website
+	}
+	if _, err := url.ParseRequestURI(profile.Website); err != nil {
+		profile.Website = ""
+	}
+	return profile, nil
+}
+
+func copyOrgAvatar(api *giteaAPI, org, avatarURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), avatarTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: avatarTimeout}
+	resp, err := client.Do(req) //nolint:gosec // the URL comes from the GitHub API
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download avatar: %s", resp.Status)
+	}
+	image, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarSize))
+	if err != nil {
+		return err
+	}
+
+	return api.do(http.MethodPost, fmt.Sprintf("/orgs/%s/avatar", url.PathEscape(org)), map[string]string{
+		"image": base64.StdEncoding.EncodeToString(image),
+	}, nil)
+}
+
+func truncate(s string, length int) string {
+	runes := []rune(s)
+	if len(runes) <= length {
+		return s
+	}
+	return string(runes[:length])
+}
@@ -0,0 +1,148 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+)
+
+// lfsBatchLimit bounds the size of a Git LFS batch request read to check its operation
+const lfsBatchLimit = 1024 * 1024
+
+// proxyTokenKey is the request context key of the token the proxy adds to a request
+type proxyTokenKey struct{}
+
+// runProxySidecar proxies smart HTTP git fetches to GitHub, adding an installation token for
+// the repository to each request. Mirrors created through the proxy have no credentials, so
+// tokens are never stored in Gitea's database or on disk.
+func (m *Mirror) runProxySidecar() {
+	target := m.githubGitURL()
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Header.Del("Cookie")
+			token, _ := r.In.Context().Value(proxyTokenKey{}).(string)
+			r.Out.SetBasicAuth("x-access-token", token)
+		},
+	}
+	server := m.startSidecarServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.handleProxy(proxy, w, r)
+	}))
+
+	<-m.stopChan
+	stopSidecarServer(server)
+	slog.Info("Sidecar stopped")
+	m.didSidecarStopChan <- struct{}{}
+}
+
+// handleProxy forwards a fetch of /<owner>/<repo>.git to GitHub. Only the requests git and
+// Git LFS make to fetch are allowed, so the proxy cannot be used to push or call the API.
+func (m *Mirror) handleProxy(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	owner, repo, rest := parts[0], parts[1], parts[2]
+	if !proxyAllowed(r.Method, rest, r.URL.Query()) {
+		http.Error(w, "only fetches are proxied", http.StatusForbidden)
+		return
+	}
+	if rest == "info/lfs/objects/batch" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, lfsBatchLimit))
+		if err != nil {
+			http.Error(w, "failed to read LFS batch request", http.StatusBadRequest)
+			return
+		}
+		var batch struct {
+			Operation string `json:"operation"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil || batch.Operation != "download" {
+			http.Error(w, "only LFS downloads are proxied", http.StatusForbidden)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	githubAppClient, err := m.getGitHubAppClient()
+	if err != nil {
+		slog.Error("Error authenticating", "error", err)
+		http.Error(w, "failed to authenticate", http.StatusServiceUnavailable)
+		return
+	}
+	// Wikis are covered by the token of their repository
+	name := strings.TrimSuffix(strings.TrimSuffix(repo, ".git"), ".wiki")
+	installationID, err := installationTokens.installationFor(githubAppClient, owner, name)
+	if err != nil {
+		slog.Error("Error finding installation", "repo", owner+"/"+name, "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarProxy)).Inc()
+		http.Error(w, "failed to find installation", http.StatusBadGateway)
+		return
+	}
+	if installationID == 0 {
+		slog.Info("Not proxying", "repo", owner+"/"+name, "reason", "GitHub App is not installed on the repository")
+		http.Error(w, "GitHub App is not installed on the repository", http.StatusForbidden)
+		return
+	}
+	// Always scoped to fetching the one repository, whatever the token scope, so the proxy
+	// never holds a token that can write
+	token, _, err := installationTokens.get(githubAppClient, tokenScope{
+		installationID: installationID,
+		repository:     strings.ToLower(name),
+		access:         accessFetch,
+	})
+	if err != nil {
+		slog.Error("Error creating installation token", "repo", owner+"/"+name, "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarProxy)).Inc()
+		http.Error(w, "failed to create installation token", http.StatusBadGateway)
+		return
+	}
+	metrics.SidecarRotations.WithLabelValues(string(configPkg.SidecarProxy)).Inc()
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyTokenKey{}, token)))
+}
+
+// proxyAllowed returns true for the requests of a smart HTTP fetch and of Git LFS downloads
+func proxyAllowed(method, rest string, query url.Values) bool {
+	switch {
+	case method == http.MethodGet && rest == "info/refs":
+		return query.Get("service") == "git-upload-pack"
+	case method == http.MethodPost && rest == "git-upload-pack":
+		return true
+	case method == http.MethodPost && rest == "info/lfs/objects/batch":
+		// The batch operation is in the body, which handleProxy checks is a download
+		return true
+	}
+	return false
+}
+
+// githubGitURL returns the base URL git repositories are served from on the GitHub host
+func (m *Mirror) githubGitURL() *url.URL {
+	if m.config.GitHubAuth.EnterpriseURL != "" {
+		if enterpriseURL, err := url.Parse(m.config.GitHubAuth.EnterpriseURL); err == nil {
+			return &url.URL{Scheme: enterpriseURL.Scheme, Host: enterpriseURL.Host}
+		}
+	}
+	return &url.URL{Scheme: "https", Host: "github.com"}
+}
+
+// proxyCloneURL returns the URL Gitea clones a GitHub repository through the proxy sidecar at
+func proxyCloneURL(proxyURL, cloneURL string) (string, error) {
+	base, err := url.Parse(proxyURL)
+	if err != nil {
+		return "", err
+	}
+	clone, err := url.Parse(cloneURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(base.String(), "/") + clone.Path, nil
+}
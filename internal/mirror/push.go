@@ -0,0 +1,234 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/google/go-github/v62/github"
+)
+
+// giteaRepository is a Gitea repository along with the fields the Gitea SDK does not decode
+type giteaRepository struct {
+	gitea.Repository
+	Topics   []string `json:"topics"`
+	Language string   `json:"language"`
+}
+
+// toGitHubRepository describes a Gitea repository as a GitHub repository, so that the
+// filters and name templates written for GitHub sources apply to Gitea sources too
+func (r *giteaRepository) toGitHubRepository() *github.Repository {
+	visibility := "public"
+	if r.Private {
+		visibility = "private"
+	} else if r.Internal {
+		visibility = "internal"
+	}
+	var owner *github.User
+	if r.Owner != nil {
+		owner = &github.User{Login: github.String(r.Owner.UserName)}
+	}
+	return &github.Repository{
+		Owner:           owner,
+		Name:            github.String(r.Name),
+		FullName:        github.String(r.FullName),
+		Description:     github.String(r.Description),
+		Homepage:        github.String(r.Website),
+		Private:         github.Bool(r.Private || r.Internal),
+		Visibility:      github.String(visibility),
+		Fork:            github.Bool(r.Fork),
+		Archived:        github.Bool(r.Archived),
+		Size:            github.Int(r.Size),
+		StargazersCount: github.Int(r.Stars),
+		Language:        github.String(r.Language),
+		Topics:          r.Topics,
+		PushedAt:        &github.Timestamp{Time: r.Updated},
+	}
+}
+
+// pushMirror is a Gitea push mirror
+type pushMirror struct {
+	RemoteName    string `json:"remote_name"`
+	RemoteAddress string `json:"remote_address"`
+	Interval      string `json:"interval"`
+	SyncOnCommit  bool   `json:"sync_on_commit"`
+}
+
+// runPushMirror configures a Gitea push mirror to GitHub for each Gitea repository matching
+// the mirror's filter, creating the GitHub repositories first if they are missing. index is
+// the mirror's index in the config, which labels its metrics. It returns an error if any
+// repository failed.
+func runPushMirror(config *configPkg.Config, index string, mirror configPkg.MirrorConfig, githubClient *github.Client, githubAppClient *github.Client, api *giteaAPI, targets map[string]string) error {
+	repos, err := listGiteaRepos(api, mirror.From)
+	if err != nil {
+		return fmt.Errorf("failed to list Gitea repos: %w", err)
+	}
+	failed := 0
+	countRepo := func(result string) {
+		if result == metrics.ResultFailed {
+			failed++
+		}
+		metrics.ReposTotal.WithLabelValues(index, string(configPkg.Push), mirror.From.Name, result).Inc()
+	}
+
+	listed := 0
+	for _, giteaRepo := range repos {
+		// Pushing a pull mirror back out to GitHub would only copy GitHub to itself
+		if giteaRepo.Mirror {
+			continue
+		}
+		githubRepo := giteaRepo.toGitHubRepository()
+		if !mirror.From.Filter.Match(githubRepo) {
+			continue
+		}
+		listed++
+
+		owner, name, err := mirror.Target(githubRepo)
+		if err != nil {
+			slog.Error("Error naming mirror", "repository", giteaRepo.FullName, "error", err)
+			countRepo(metrics.ResultFailed)
+			continue
+		}
+		target := "github:" + strings.ToLower(owner+"/"+name)
+		if source, ok := targets[target]; ok && source != giteaRepo.FullName {
+			slog.Error("Mirror target collision, skipping", "repository", giteaRepo.FullName, "target", owner+"/"+name, "conflicts-with", source)
+			countRepo(metrics.ResultSkipped)
+			continue
+		}
+		targets[target] = giteaRepo.FullName
+
+		slog.Info("Push mirroring", "repository", giteaRepo.FullName, "target", owner+"/"+name)
+		remote, err := ensureGitHubRepo(config, githubClient, owner, name, githubRepo)
+		if err != nil {
+			slog.Error("Error creating GitHub repository", "target", owner+"/"+name, "error", err)
+			countRepo(metrics.ResultFailed)
+			continue
+		}
+		created, err := ensurePushMirror(config, githubAppClient, api, giteaRepo, remote)
+		switch {
+		case err != nil:
+			slog.Error("Error creating push mirror", "repository", giteaRepo.FullName, "error", err)
+			countRepo(metrics.ResultFailed)
+		case created:
+			countRepo(metrics.ResultCreated)
+		default:
+			countRepo(metrics.ResultSkipped)
+		}
+	}
+	metrics.ReposListed.WithLabelValues(index, string(configPkg.Push), mirror.From.Name).Set(float64(listed))
+	if failed > 0 {
+		return fmt.Errorf("failed to push mirror %d repositories", failed)
+	}
+	return nil
+}
+
+// listGiteaRepos returns every repository of the Gitea user or organization
+func listGiteaRepos(api *giteaAPI, from configPkg.MirrorFromEntityConfig) ([]*giteaRepository, error) {
+	path := fmt.Sprintf("/users/%s/repos", url.PathEscape(from.Name))
+	if strings.ToLower(string(from.Type)) == string(configPkg.Organization) {
+		path = fmt.Sprintf("/orgs/%s/repos", url.PathEscape(from.Name))
+	}
+
+	const limit = 50
+	var repos []*giteaRepository
+	for page := 1; ; page++ {
+		var pageRepos []*giteaRepository
+		if err := api.do(http.MethodGet, fmt.Sprintf("%s?page=%d&limit=%d", path, page, limit), nil, &pageRepos); err != nil {
+			return nil, err
+		}
+		// Gitea may return fewer than limit per page, so only an empty page is the last
+		if len(pageRepos) == 0 {
+			return repos, nil
+		}
+		repos = append(repos, pageRepos...)
+	}
+}
+
+// ensureGitHubRepo creates the GitHub repository if it does not exist, and returns its clone URL
+func ensureGitHubRepo(config *configPkg.Config, client *github.Client, owner, name string, source *github.Repository) (string, error) {
+	existing, resp, err := client.Repositories.Get(context.Background(), owner, name)
+	if err == nil {
+		return existing.GetCloneURL(), nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return "", err
+	}
+
+	// Repositories are created in an organization by name, or for the authenticated user with
+	// an empty name. GitHub Apps cannot create repositories for users.
+	org := owner
+	ownerUser, _, err := client.Users.Get(context.Background(), owner)
+	if err != nil {
+		return "", fmt.Errorf("failed to get owner: %w", err)
+	}
+	if ownerUser.GetType() != "Organization" {
+		if config.GitHubAuth.Token == "" {
+			return "", fmt.Errorf("GitHub Apps can only create repositories in organizations")
+		}
+		// Without an organization, GitHub creates the repository for the token's own user
+		authenticated, _, err := client.Users.Get(context.Background(), "")
+		if err != nil {
+			return "", fmt.Errorf("failed to get authenticated user: %w", err)
+		}
+		if !strings.EqualFold(authenticated.GetLogin(), owner) {
+			return "", fmt.Errorf("the GitHub token belongs to %s, so it cannot create repositories for user %s", authenticated.GetLogin(), owner)
+		}
+		org = ""
+	}
+
+	slog.Info("Creating GitHub repository", "target", owner+"/"+name)
+	created, _, err := client.Repositories.Create(context.Background(), org, &github.Repository{
+		Name:        github.String(name),
+		Description: source.Description,
+		Homepage:    source.Homepage,
+		Private:     source.Private,
+	})
+	if err != nil {
+		return "", err
+	}
+	return created.GetCloneURL(), nil
+}
+
+// ensurePushMirror adds a push mirror to the remote unless the Gitea repository already has
+// one, and returns whether it was added
+func ensurePushMirror(config *configPkg.Config, githubAppClient *github.Client, api *giteaAPI, giteaRepo *giteaRepository, remote string) (bool, error) {
+	owner, name := giteaRepo.Owner.UserName, giteaRepo.Name
+
+	var mirrors []pushMirror
+	if err := api.do(http.MethodGet, fmt.Sprintf("/repos/%s/%s/push_mirrors", url.PathEscape(owner), url.PathEscape(name)), nil, &mirrors); err != nil {
+		return false, fmt.Errorf("failed to list push mirrors: %w", err)
+	}
+	for _, mirror := range mirrors {
+		if strings.EqualFold(strings.TrimSuffix(mirror.RemoteAddress, ".git"), strings.TrimSuffix(remote, ".git")) {
+			return false, nil
+		}
+	}
+
+	remoteURL, err := url.Parse(remote)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse remote: %w", err)
+	}
+	_, remoteName := repoFromURL(remoteURL)
+	token, err := mirroringToken(config, githubAppClient, remoteName, accessPush)
+	if err != nil {
+		return false, fmt.Errorf("failed to create installation token: %w", err)
+	}
+	slog.Info("Creating push mirror", "repository", giteaRepo.FullName, "remote", remote)
+	err = api.do(http.MethodPost, fmt.Sprintf("/repos/%s/%s/push_mirrors", url.PathEscape(owner), url.PathEscape(name)), gitea.CreatePushMirrorOption{
+		RemoteAddress:  remote,
+		RemoteUsername: "oauth2",
+		RemotePassword: token,
+		Interval:       "10m",
+		SyncONCommit:   true,
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
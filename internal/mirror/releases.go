@@ -0,0 +1,199 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/google/go-github/v62/github"
+)
+
+// syncReleases creates, updates, and deletes Gitea releases to match the most recent GitHub
+// releases, and uploads any release assets Gitea is missing
+func syncReleases(githubClient *github.Client, giteaClient *gitea.Client, config configPkg.ReleaseSyncConfig, owner, name string, githubRepo *github.Repository) error {
+	// Deleting needs every GitHub release to tell which Gitea releases are gone
+	limit := config.Limit()
+	if config.Delete {
+		limit = 0
+	}
+	githubReleases, err := listGitHubReleases(githubClient, githubRepo.GetOwner().GetLogin(), githubRepo.GetName(), limit)
+	if err != nil {
+		return fmt.Errorf("failed to list GitHub releases: %w", err)
+	}
+	giteaReleases, err := listGiteaReleases(giteaClient, owner, name)
+	if err != nil {
+		return fmt.Errorf("failed to list Gitea releases: %w", err)
+	}
+
+	githubTags := make(map[string]bool, len(githubReleases))
+	for _, release := range githubReleases {
+		githubTags[release.GetTagName()] = true
+	}
+
+	synced := 0
+	for _, release := range githubReleases {
+		if synced >= config.Limit() {
+			break
+		}
+		// Drafts have no tag in git yet, so they cannot be mirrored
+		if release.GetDraft() {
+			continue
+		}
+		synced++
+
+		giteaRelease, err := upsertRelease(giteaClient, owner, name, release, giteaReleases[release.GetTagName()])
+		if err != nil {
+			slog.Error("Error syncing release", "repo", owner+"/"+name, "tag", release.GetTagName(), "error", err)
+			continue
+		}
+		if err := syncReleaseAssets(githubClient, giteaClient, config, owner, name, githubRepo, release, giteaRelease); err != nil {
+			slog.Error("Error syncing release assets", "repo", owner+"/"+name, "tag", release.GetTagName(), "error", err)
+		}
+	}
+
+	if config.Delete {
+		for tag, release := range giteaReleases {
+			if githubTags[tag] {
+				continue
+			}
+			slog.Info("Deleting release", "repo", owner+"/"+name, "tag", tag)
+			if _, err := giteaClient.DeleteRelease(owner, name, release.ID); err != nil {
+				slog.Error("Error deleting release", "repo", owner+"/"+name, "tag", tag, "error", err)
+			} else {
+				metrics.ReconcileChanges.WithLabelValues("releases").Inc()
+			}
+		}
+	}
+	return nil
+}
+
+// listGitHubReleases returns the GitHub releases newest first, stopping at the page holding
+// the limit'th release that is not a draft. Every release is returned when limit is 0.
+func listGitHubReleases(client *github.Client, owner, repo string, limit int) ([]*github.RepositoryRelease, error) {
+	var releases []*github.RepositoryRelease
+	published := 0
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Repositories.ListReleases(context.Background(), owner, repo, opt)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, page...)
+		for _, release := range page {
+			if !release.GetDraft() {
+				published++
+			}
+		}
+		if resp.NextPage == 0 || (limit > 0 && published >= limit) {
+			return releases, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// listGiteaReleases returns the Gitea releases keyed by tag. Tags without a release are not included.
+func listGiteaReleases(client *gitea.Client, owner, repo string) (map[string]*gitea.Release, error) {
+	releases := make(map[string]*gitea.Release)
+	opt := gitea.ListReleasesOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}}
+	for {
+		page, resp, err := client.ListReleases(owner, repo, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, release := range page {
+			releases[release.TagName] = release
+		}
+		if resp.NextPage == 0 {
+			return releases, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func upsertRelease(client *gitea.Client, owner, name string, release *github.RepositoryRelease, existing *gitea.Release) (*gitea.Release, error) {
+	title := release.GetName()
+	if strings.TrimSpace(title) == "" {
+		title = release.GetTagName()
+	}
+
+	if existing == nil {
+		slog.Info("Creating release", "repo", owner+"/"+name, "tag", release.GetTagName())
+		created, _, err := client.CreateRelease(owner, name, gitea.CreateReleaseOption{
+			TagName:      release.GetTagName(),
+			Target:       release.GetTargetCommitish(),
+			Title:        title,
+			Note:         release.GetBody(),
+			IsPrerelease: release.GetPrerelease(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		metrics.ReconcileChanges.WithLabelValues("releases").Inc()
+		return created, nil
+	}
+
+	if existing.Title == title && existing.Note == release.GetBody() && existing.IsPrerelease == release.GetPrerelease() && !existing.IsDraft {
+		return existing, nil
+	}
+	slog.Info("Updating release", "repo", owner+"/"+name, "tag", release.GetTagName())
+	isDraft := false
+	isPrerelease := release.GetPrerelease()
+	updated, _, err := client.EditRelease(owner, name, existing.ID, gitea.EditReleaseOption{
+		Title:        title,
+		Note:         release.GetBody(),
+		IsDraft:      &isDraft,
+		IsPrerelease: &isPrerelease,
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.ReconcileChanges.WithLabelValues("releases").Inc()
+	// The edit response may omit assets, so keep the ones already listed
+	if len(updated.Attachments) == 0 {
+		updated.Attachments = existing.Attachments
+	}
+	return updated, nil
+}
+
+// syncReleaseAssets uploads GitHub assets that are missing from the Gitea release or whose size
+// changed, skipping any larger than the configured limit
+func syncReleaseAssets(githubClient *github.Client, giteaClient *gitea.Client, config configPkg.ReleaseSyncConfig, owner, name string, githubRepo *github.Repository, release *github.RepositoryRelease, giteaRelease *gitea.Release) error {
+	attachments := make(map[string]*gitea.Attachment, len(giteaRelease.Attachments))
+	for _, attachment := range giteaRelease.Attachments {
+		attachments[attachment.Name] = attachment
+	}
+
+	for _, asset := range release.Assets {
+		if config.MaxAssetSize > 0 && int64(asset.GetSize()) > config.MaxAssetSize {
+			slog.Warn("Skipping release asset larger than max-asset-size", "repo", owner+"/"+name, "tag", release.GetTagName(), "asset", asset.GetName(), "size", asset.GetSize())
+			continue
+		}
+		existing, ok := attachments[asset.GetName()]
+		if ok && existing.Size == int64(asset.GetSize()) {
+			continue
+		}
+		if ok {
+			if _, err := giteaClient.DeleteReleaseAttachment(owner, name, giteaRelease.ID, existing.ID); err != nil {
+				return fmt.Errorf("failed to replace asset %s: %w", asset.GetName(), err)
+			}
+		}
+
+		slog.Info("Uploading release asset", "repo", owner+"/"+name, "tag", release.GetTagName(), "asset", asset.GetName())
+		rc, _, err := githubClient.Repositories.DownloadReleaseAsset(context.Background(), githubRepo.GetOwner().GetLogin(), githubRepo.GetName(), asset.GetID(), http.DefaultClient)
+		if err != nil {
+			return fmt.Errorf("failed to download asset %s: %w", asset.GetName(), err)
+		}
+		_, _, err = giteaClient.CreateReleaseAttachment(owner, name, giteaRelease.ID, rc, asset.GetName())
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to upload asset %s: %w", asset.GetName(), err)
+		}
+		metrics.ReconcileChanges.WithLabelValues("releases").Inc()
+	}
+	return nil
+}
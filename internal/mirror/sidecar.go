@@ -2,146 +2,315 @@ package mirror
 
 import (
 	"context"
+	"fmt"
+	"io/fs"
 	"log/slog"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/bradleyfalzon/ghinstallation/v2"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
 	git "github.com/go-git/go-git/v5"
-	gitConfig "github.com/go-git/go-git/v5/config"
-	"github.com/gofri/go-github-ratelimit/github_ratelimit"
 	"github.com/google/go-github/v62/github"
 )
 
+// pushMirrorRemotePrefix is the prefix of the remotes Gitea creates for push mirrors
+const pushMirrorRemotePrefix = "remote_mirror_"
+
+// runSidecar rewrites the remotes of every repository under the repos paths whenever installation
+// tokens are about to expire, rather than on a fixed interval
 func (m *Mirror) runSidecar() {
+	var installationOwner string
+	var nextAt time.Time
 	reposChan := make(chan string)
-	go findRepos(m.config.GiteaAuth.ReposPath, reposChan)
+	// done is closed when the sidecar stops, so walks and watchers stop sending to reposChan
+	done := make(chan struct{})
+	defer close(done)
+	refresh := time.NewTimer(0)
+	defer refresh.Stop()
+
+	// The periodic walk stays as a safety net for anything the watchers miss
+	for _, root := range m.config.GiteaAuth.RepoRoots() {
+		watcher, err := watchRepos(root, reposChan, done)
+		if err != nil {
+			slog.Error("Error watching repos, relying on periodic walks", "path", root, "error", err)
+			continue
+		}
+		defer watcher.Close()
+	}
+
 	for {
+		m.sidecarBeat.beat()
 		select {
 		case <-m.stopChan:
 			slog.Info("Sidecar stopped")
 			m.didSidecarStopChan <- struct{}{}
 			return
 		case repo := <-reposChan:
-			slog.Info("Repo found", "repo", repo)
-			gitRepo, err := git.PlainOpen(repo)
-			if err != nil {
-				slog.Error("Error opening repo", "error", err)
+			if nextAt.IsZero() {
+				// Picked up by the walk once the first refresh starts
 				continue
 			}
-
-			// Grab the remote URL
-			remote, err := gitRepo.Remote("origin")
-			if err != nil {
-				// This is a valid situation where the repo is not mirrored
-				continue
+			slog.Info("Repo found", "repo", repo)
+			// Tokens reused from the cache may expire before the schedule assumes
+			expiresAt := m.refreshRepo(repo, installationOwner)
+			if !expiresAt.IsZero() && expiresAt.Before(nextAt) {
+				nextAt = expiresAt
+				refresh.Reset(nextRefresh(nextAt))
 			}
 
-			remoteURL := remote.Config().URLs[0]
-
-			properURL, err := url.Parse(remoteURL)
+		case <-refresh.C:
+			githubAppClient, err := m.getGitHubAppClient()
 			if err != nil {
-				slog.Error("Error parsing remote URL", "error", err)
+				slog.Error("Error authenticating", "error", err)
+				refresh.Reset(time.Minute)
 				continue
 			}
-
-			if properURL.User == nil {
-				slog.Error("No user in remote URL")
-				continue
-			}
-
-			// Check if the PAT is valid
-			pat, ok := properURL.User.Password()
-			if !ok {
-				slog.Error("No password found in remote URL")
-				continue
-			}
-
-			if properURL.User.Username() == "oauth2" && pat != "" {
-				rateLimiter, err := github_ratelimit.NewRateLimitWaiterClient(nil)
+			if m.config.SidecarOwnedOnly && installationOwner == "" {
+				installationOwner, err = getInstallationOwner(githubAppClient, int64(m.config.GitHubAuth.InstallationID))
 				if err != nil {
-					slog.Error("Error creating rate limiter", "error", err)
+					slog.Error("Error getting installation", "error", err)
+					refresh.Reset(time.Minute)
 					continue
 				}
+			}
+			// Lowered to the earliest expiry of the tokens written as repositories are refreshed
+			nextAt = time.Now().Add(time.Hour)
+			slog.Info("Rotating installation tokens")
+			go findRepos(m.config.GiteaAuth.RepoRoots(), reposChan, done)
+			refresh.Reset(nextRefresh(nextAt))
+		}
+	}
+}
 
-				privatePem, err := os.ReadFile(m.config.GitHubAuth.PrivateKeyPath)
-				if err != nil {
-					slog.Error("Error reading private key", "error", err)
-					continue
-				}
+// refreshRepo writes installation tokens into the remotes of a bare repository. That is the
+// origin remote of a pull mirror, and the remote_mirror_* remotes Gitea creates for push
+// mirrors. Each remote gets a token of the installation covering its repository. If
+// installationOwner is set, only remotes of repositories it owns are rotated. It returns the
+// earliest expiry of the tokens written.
+func (m *Mirror) refreshRepo(repo, installationOwner string) time.Time {
+	var earliest time.Time
+	githubAppClient, err := m.getGitHubAppClient()
+	if err != nil {
+		slog.Error("Error authenticating", "error", err)
+		return earliest
+	}
+	gitRepo, err := git.PlainOpen(repo)
+	if err != nil {
+		slog.Error("Error opening repo", "error", err)
+		return earliest
+	}
 
-				appItr, err := ghinstallation.NewAppsTransport(rateLimiter.Transport, int64(m.config.GitHubAuth.AppID), privatePem)
-				if err != nil {
-					slog.Error("Error creating app transport", "error", err)
-					continue
-				}
-				githubAppClient := github.NewClient(&http.Client{Transport: appItr})
+	remotes, err := gitRepo.Remotes()
+	if err != nil {
+		slog.Error("Error listing remotes", "repo", repo, "error", err)
+		return earliest
+	}
+	for _, remote := range remotes {
+		remoteConfig := remote.Config()
+		if len(remoteConfig.URLs) == 0 {
+			continue
+		}
+		// Repos that are not mirrored have no remotes to refresh
+		if remoteConfig.Name != "origin" && !strings.HasPrefix(remoteConfig.Name, pushMirrorRemotePrefix) {
+			continue
+		}
+		properURL, reason := m.rotatableRemote(remoteConfig.URLs[0], installationOwner)
+		if reason != "" {
+			slog.Info("Skipping remote", "repo", repo, "remote", remoteConfig.Name, "reason", reason)
+			continue
+		}
+		access := accessFetch
+		if remoteConfig.Name != "origin" {
+			access = accessPush
+		}
+		token, reason, err := m.remoteInstallationToken(githubAppClient, properURL, access)
+		if err != nil {
+			slog.Error("Error creating installation token", "repo", repo, "remote", remoteConfig.Name, "error", err)
+			metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarFilesystem)).Inc()
+			continue
+		}
+		if reason != "" {
+			slog.Info("Skipping remote", "repo", repo, "remote", remoteConfig.Name, "reason", reason)
+			continue
+		}
+		refreshRemote(repo, remoteConfig.Name, properURL, token.token)
+		if earliest.IsZero() || token.expiresAt.Before(earliest) {
+			earliest = token.expiresAt
+		}
+	}
+	return earliest
+}
 
-				// Assume PAT is invalid and refresh it
-				slog.Info("Refreshing", "repo", repo, "error", err)
-				installToken, _, err := githubAppClient.Apps.CreateInstallationToken(context.Background(), int64(m.config.GitHubAuth.InstallationID), &github.InstallationTokenOptions{})
-				if err != nil {
-					slog.Error("Error creating installation token", "error", err)
-					continue
-				}
-				properURL.User = url.UserPassword("oauth2", installToken.GetToken())
-				// Save the change
-				err = gitRepo.DeleteRemote("origin")
-				if err != nil {
-					slog.Error("Error deleting remote", "error", err)
-					continue
-				}
+// rotatableRemote parses a remote URL, returning why its token must not be rotated if so.
+// Only oauth2 tokens for the configured GitHub host are rotated, optionally limited to
+// repositories owned by installationOwner.
+func (m *Mirror) rotatableRemote(remoteURL, installationOwner string) (*url.URL, string) {
+	properURL, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, "invalid remote URL"
+	}
+	if !m.isGitHubURL(remoteURL) {
+		return nil, "not the configured GitHub host"
+	}
+	if properURL.User == nil {
+		return nil, "no credentials in remote URL"
+	}
+	if pat, ok := properURL.User.Password(); !ok || pat == "" {
+		return nil, "no token in remote URL"
+	}
+	if properURL.User.Username() != "oauth2" {
+		return nil, "not an oauth2 token"
+	}
+	if installationOwner != "" {
+		owner, _ := repoFromURL(properURL)
+		if !strings.EqualFold(owner, installationOwner) {
+			return nil, "owner is not covered by the installation"
+		}
+	}
+	return properURL, ""
+}
 
-				_, err = gitRepo.CreateRemote(&gitConfig.RemoteConfig{
-					Name: "origin",
-					URLs: []string{properURL.String()},
-				})
-				if err != nil {
-					slog.Error("Error creating remote", "error", err)
-					continue
-				}
-				slog.Info("Updated remote URL")
-			}
+// remoteInstallationToken returns a token for the access of the installation covering the
+// repository the GitHub URL points at, or why there is none
+func (m *Mirror) remoteInstallationToken(githubAppClient *github.Client, remoteURL *url.URL, access tokenAccess) (installationToken, string, error) {
+	owner, name := repoFromURL(remoteURL)
+	if owner == "" || name == "" {
+		return installationToken{}, "no repository in remote URL", nil
+	}
+	installationID, err := installationTokens.installationFor(githubAppClient, owner, name)
+	if err != nil {
+		return installationToken{}, "", fmt.Errorf("failed to find installation: %w", err)
+	}
+	if installationID == 0 {
+		return installationToken{}, "GitHub App is not installed on the repository", nil
+	}
+	token, expiresAt, err := installationTokens.get(githubAppClient, newTokenScope(m.config, installationID, name, access))
+	if err != nil {
+		return installationToken{}, "", err
+	}
+	return installationToken{token: token, expiresAt: expiresAt}, "", nil
+}
 
-		case <-time.After(50 * time.Minute):
-			go findRepos(m.config.GiteaAuth.ReposPath, reposChan)
+// repoFromURL returns the owner and name of the repository a GitHub URL points at. Wikis
+// are covered by the token of their repository, so a wiki URL returns the repository.
+func repoFromURL(remoteURL *url.URL) (string, string) {
+	owner, name, _ := strings.Cut(strings.Trim(remoteURL.Path, "/"), "/")
+	return owner, strings.TrimSuffix(strings.TrimSuffix(name, ".git"), ".wiki")
+}
+
+func refreshRemote(repo, remote string, properURL *url.URL, token string) {
+	if pat, _ := properURL.User.Password(); pat == token {
+		// Already rotated with the current token
+		return
+	}
+	slog.Info("Refreshing", "repo", repo, "remote", remote)
+	properURL.User = url.UserPassword("oauth2", token)
+	// Only the URL changes, so the rest of the remote's settings such as push mirroring are kept
+	if err := rewriteRemoteURL(repo, remote, properURL.String()); err != nil {
+		slog.Error("Error updating remote URL", "repo", repo, "remote", remote, "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarFilesystem)).Inc()
+		return
+	}
+	slog.Info("Updated remote URL", "remote", remote)
+	metrics.SidecarRotations.WithLabelValues(string(configPkg.SidecarFilesystem)).Inc()
+}
+
+// getInstallationOwner returns the login of the account the GitHub App installation belongs to
+func getInstallationOwner(githubAppClient *github.Client, installationID int64) (string, error) {
+	installation, _, err := githubAppClient.Apps.GetInstallation(context.Background(), installationID)
+	if err != nil {
+		return "", err
+	}
+	return installation.GetAccount().GetLogin(), nil
+}
+
+// isGitHubURL returns true if the URL points at github.com or the configured GitHub Enterprise host
+func (m *Mirror) isGitHubURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := "github.com"
+	if m.config.GitHubAuth.EnterpriseURL != "" {
+		enterpriseURL, err := url.Parse(m.config.GitHubAuth.EnterpriseURL)
+		if err != nil {
+			return false
 		}
+		host = enterpriseURL.Hostname()
 	}
+	return strings.EqualFold(parsed.Hostname(), host)
 }
 
-func findRepos(basePath string, reposChan chan string) {
+// findRepos walks each root once and sends every git repository found to reposChan. Any
+// directory layout works: bare repositories are recognized by their contents rather than a
+// <owner>/<repo>.git layout, which includes wiki repositories, and the walk does not descend
+// into repositories. A repository reachable through more than one root is sent once. The
+// walk stops once done is closed.
+func findRepos(roots []string, reposChan chan string, done <-chan struct{}) {
 	slog.Info("Finding repos")
-	// Iterate through the directories in basePath, these are the usernames or orgs
-	// For each username or org, iterate through the directories, these are the repos
-	// Send the repo name to the reposChan
+	seen := make(map[string]bool)
+	stopped := false
+	send := func(repo string) {
+		key := repo
+		if resolved, err := filepath.EvalSymlinks(repo); err == nil {
+			key = resolved
+		}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		select {
+		case reposChan <- repo:
+		case <-done:
+			stopped = true
+		}
+	}
 
-	err := filepath.Walk(basePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, root := range roots {
+		if stopped {
+			return
 		}
-		if info.IsDir() {
-			// Walk the directory to get the repos
-			err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.IsDir() && strings.HasSuffix(path, ".git") {
-					reposChan <- path
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				// Skip what cannot be read rather than abandoning the rest of the walk
+				slog.Error("Error walking path", "path", path, "error", err)
+				if entry != nil && entry.IsDir() && path != root {
+					return filepath.SkipDir
 				}
 				return nil
-			})
-			if err != nil {
-				slog.Error("Error walking path", "error", err)
 			}
+			if !entry.IsDir() {
+				return nil
+			}
+			if entry.Name() == ".git" {
+				// The git directory of a non-bare repository
+				send(filepath.Dir(path))
+			} else if isBareRepo(path) {
+				send(path)
+			} else {
+				return nil
+			}
+			if stopped {
+				return filepath.SkipAll
+			}
+			return filepath.SkipDir
+		})
+		if err != nil {
+			slog.Error("Error walking path", "path", root, "error", err)
 		}
-		return nil
-	})
-	if err != nil {
-		slog.Error("Error walking path", "error", err)
 	}
+}
 
+// isBareRepo returns true if the directory looks like a bare git repository
+func isBareRepo(path string) bool {
+	for _, name := range []string{"HEAD", "config", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			return false
+		}
+	}
+	return true
 }
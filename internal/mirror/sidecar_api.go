@@ -0,0 +1,326 @@
+package mirror
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/google/go-github/v62/github"
+)
+
+// runAPISidecar rotates GitHub App installation tokens through the Gitea API, so the sidecar
+// needs neither the Gitea data volume nor to race Gitea's own writes to the git config
+func (m *Mirror) runAPISidecar() {
+	refresh := time.NewTimer(0)
+	defer refresh.Stop()
+	for {
+		m.sidecarBeat.beat()
+		select {
+		case <-m.stopChan:
+			slog.Info("Sidecar stopped")
+			m.didSidecarStopChan <- struct{}{}
+			return
+		case <-refresh.C:
+			githubAppClient, err := m.getGitHubAppClient()
+			if err != nil {
+				slog.Error("Error authenticating", "error", err)
+				refresh.Reset(time.Minute)
+				continue
+			}
+			refresh.Reset(m.refreshAPIMirrors(githubAppClient))
+		}
+	}
+}
+
+// refreshAPIMirrors re-creates every push mirror to GitHub with a token of the installation
+// covering its repository, and returns how long until the earliest of the tokens must be
+// replaced. Gitea's API cannot change the credentials of a pull mirror, so pull mirrors are
+// only re-created, repository and all, when that is enabled, and are otherwise reported.
+func (m *Mirror) refreshAPIMirrors(githubAppClient *github.Client) time.Duration {
+	// Lowered to the earliest expiry of the tokens used
+	expiresAt := time.Now().Add(time.Hour)
+	var installationOwner string
+	var err error
+	if m.config.SidecarOwnedOnly {
+		installationOwner, err = getInstallationOwner(githubAppClient, int64(m.config.GitHubAuth.InstallationID))
+		if err != nil {
+			slog.Error("Error getting installation", "error", err)
+			return time.Minute
+		}
+	}
+	slog.Info("Refreshing mirrors through the Gitea API")
+	api := newGiteaAPI(m.config)
+
+	repos, err := searchGiteaRepos(api)
+	if err != nil {
+		slog.Error("Error listing Gitea repos", "error", err)
+		return time.Minute
+	}
+
+	pullMirrors := 0
+	for _, repo := range repos {
+		if repo.Mirror {
+			if m.isGitHubURL(repo.OriginalURL) {
+				pullMirrors++
+			}
+			continue
+		}
+		owner, name := repo.Owner.UserName, repo.Name
+		var mirrors []pushMirror
+		if err := api.do(http.MethodGet, fmt.Sprintf("/repos/%s/%s/push_mirrors", url.PathEscape(owner), url.PathEscape(name)), nil, &mirrors); err != nil {
+			slog.Error("Error listing push mirrors", "repo", repo.FullName, "error", err)
+			continue
+		}
+		for _, mirror := range mirrors {
+			if reason := m.mirrorSkipReason(mirror.RemoteAddress, installationOwner); reason != "" {
+				slog.Info("Skipping push mirror", "repo", repo.FullName, "remote", mirror.RemoteName, "reason", reason)
+				continue
+			}
+			remoteURL, err := url.Parse(mirror.RemoteAddress)
+			if err != nil {
+				slog.Info("Skipping push mirror", "repo", repo.FullName, "remote", mirror.RemoteName, "reason", "invalid remote URL")
+				continue
+			}
+			token, reason, err := m.remoteInstallationToken(githubAppClient, remoteURL, accessPush)
+			if err != nil {
+				slog.Error("Error creating installation token", "repo", repo.FullName, "remote", mirror.RemoteName, "error", err)
+				metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+				continue
+			}
+			if reason != "" {
+				slog.Info("Skipping push mirror", "repo", repo.FullName, "remote", mirror.RemoteName, "reason", reason)
+				continue
+			}
+			if token.expiresAt.Before(expiresAt) {
+				expiresAt = token.expiresAt
+			}
+			if err := recreatePushMirror(api, owner, name, mirror, token.token); err != nil {
+				slog.Error("Error refreshing push mirror", "repo", repo.FullName, "remote", mirror.RemoteName, "error", err)
+				metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+				continue
+			}
+			slog.Info("Refreshed push mirror", "repo", repo.FullName, "remote", mirror.RemoteAddress)
+			metrics.SidecarRotations.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+		}
+	}
+
+	if pullMirrors > 0 && m.config.SidecarRecreatePullMirrors {
+		if tokenExpiry, ok := m.refreshPullMirrors(githubAppClient, api, installationOwner); ok && tokenExpiry.Before(expiresAt) {
+			expiresAt = tokenExpiry
+		}
+	} else if pullMirrors > 0 {
+		slog.Warn("Gitea's API cannot update pull mirror credentials, use the filesystem sidecar mode or enable "+configPkg.SidecarRecreatePullMirrorsKey+" to refresh them", "pull-mirrors", pullMirrors)
+	}
+	return nextRefresh(expiresAt)
+}
+
+// refreshPullMirrors re-creates every pull mirror from GitHub with a fresh token, and returns
+// the earliest expiry of the tokens used and whether any were. It waits for a running mirror
+// pass, and a pass due meanwhile is skipped, so passes never see a repository mid-replacement.
+func (m *Mirror) refreshPullMirrors(githubAppClient *github.Client, api *giteaAPI, installationOwner string) (time.Time, bool) {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	// Listed again, since the pass waited for may have created repositories
+	repos, err := searchGiteaRepos(api)
+	if err != nil {
+		slog.Error("Error listing Gitea repos", "error", err)
+		return time.Time{}, false
+	}
+	names := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		names[strings.ToLower(repo.FullName)] = true
+	}
+
+	var expiresAt time.Time
+	for _, repo := range repos {
+		if !repo.Mirror || !m.isGitHubURL(repo.OriginalURL) {
+			continue
+		}
+		tokenExpiry, ok := m.refreshPullMirror(githubAppClient, api, repo, installationOwner, names)
+		if ok && (expiresAt.IsZero() || tokenExpiry.Before(expiresAt)) {
+			expiresAt = tokenExpiry
+		}
+	}
+	return expiresAt, !expiresAt.IsZero()
+}
+
+// rotationSuffix names the copy of a pull mirror migrated with a fresh token, until it
+// replaces the original
+const rotationSuffix = ".token-rotation"
+
+// refreshPullMirror migrates the pull mirror again with a fresh token under a temporary name,
+// then deletes the original and renames the copy into its place. It returns the token's
+// expiry and whether the pull mirror was refreshed. A copy left behind by an interrupted
+// refresh is renamed into place if the original is gone, and deleted otherwise.
+func (m *Mirror) refreshPullMirror(githubAppClient *github.Client, api *giteaAPI, repo *giteaRepository, installationOwner string, names map[string]bool) (time.Time, bool) {
+	owner := repo.Owner.UserName
+	if original, ok := strings.CutSuffix(repo.Name, rotationSuffix); ok {
+		if names[strings.ToLower(owner+"/"+original)] {
+			slog.Info("Deleting leftover pull mirror copy", "repo", repo.FullName)
+			if err := api.do(http.MethodDelete, repoPath(owner, repo.Name), nil, nil); err != nil {
+				slog.Error("Error deleting leftover pull mirror copy", "repo", repo.FullName, "error", err)
+			}
+			return time.Time{}, false
+		}
+		slog.Info("Restoring pull mirror copy", "repo", repo.FullName, "name", original)
+		if err := renameRepo(api, owner, repo.Name, original); err != nil {
+			slog.Error("Error restoring pull mirror copy", "repo", repo.FullName, "error", err)
+		}
+		return time.Time{}, false
+	}
+
+	if reason := m.mirrorSkipReason(repo.OriginalURL, installationOwner); reason != "" {
+		slog.Info("Skipping pull mirror", "repo", repo.FullName, "reason", reason)
+		return time.Time{}, false
+	}
+	remoteURL, err := url.Parse(repo.OriginalURL)
+	if err != nil {
+		slog.Info("Skipping pull mirror", "repo", repo.FullName, "reason", "invalid remote URL")
+		return time.Time{}, false
+	}
+	token, reason, err := m.remoteInstallationToken(githubAppClient, remoteURL, accessFetch)
+	if err != nil {
+		slog.Error("Error creating installation token", "repo", repo.FullName, "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+		return time.Time{}, false
+	}
+	if reason != "" {
+		slog.Info("Skipping pull mirror", "repo", repo.FullName, "reason", reason)
+		return time.Time{}, false
+	}
+	if err := recreatePullMirror(api, repo, token.token); err != nil {
+		slog.Error("Error refreshing pull mirror", "repo", repo.FullName, "error", err)
+		metrics.SidecarRotationFailures.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+		return time.Time{}, false
+	}
+	slog.Info("Refreshed pull mirror", "repo", repo.FullName, "remote", repo.OriginalURL)
+	metrics.SidecarRotations.WithLabelValues(string(configPkg.SidecarAPI)).Inc()
+	return token.expiresAt, true
+}
+
+// recreatePullMirror migrates the pull mirror's remote again with the token under a temporary
+// name, then replaces the original with the copy. The copy is deleted if the original cannot
+// be, so the original is only removed once its replacement is complete.
+func recreatePullMirror(api *giteaAPI, repo *giteaRepository, token string) error {
+	owner, name := repo.Owner.UserName, repo.Name
+	tempName := name + rotationSuffix
+	interval := repo.MirrorInterval
+	if interval == "" {
+		interval = "10m"
+	}
+	err := api.do(http.MethodPost, "/repos/migrate", gitea.MigrateRepoOption{
+		RepoName:       tempName,
+		RepoOwner:      owner,
+		Service:        gitea.GitServicePlain,
+		CloneAddr:      repo.OriginalURL,
+		AuthUsername:   "oauth2",
+		AuthPassword:   token,
+		Private:        repo.Private,
+		Description:    repo.Description,
+		Mirror:         true,
+		MirrorInterval: interval,
+		LFS:            true,
+	}, nil)
+	if err != nil {
+		// A failed migration can leave the copy behind
+		if cleanupErr := api.do(http.MethodDelete, repoPath(owner, tempName), nil, nil); cleanupErr != nil {
+			slog.Debug("Error deleting pull mirror copy", "repo", owner+"/"+tempName, "error", cleanupErr)
+		}
+		return fmt.Errorf("failed to migrate pull mirror copy: %w", err)
+	}
+	if err := api.do(http.MethodDelete, repoPath(owner, name), nil, nil); err != nil {
+		if cleanupErr := api.do(http.MethodDelete, repoPath(owner, tempName), nil, nil); cleanupErr != nil {
+			slog.Error("Error deleting pull mirror copy", "repo", owner+"/"+tempName, "error", cleanupErr)
+		}
+		return fmt.Errorf("failed to delete old pull mirror: %w", err)
+	}
+	if err := renameRepo(api, owner, tempName, name); err != nil {
+		// The copy is renamed on the next refresh
+		return fmt.Errorf("failed to rename pull mirror copy: %w", err)
+	}
+	return nil
+}
+
+// renameRepo renames a Gitea repository
+func renameRepo(api *giteaAPI, owner, name, newName string) error {
+	return api.do(http.MethodPatch, repoPath(owner, name), gitea.EditRepoOption{Name: &newName}, nil)
+}
+
+// repoPath returns the API path of a Gitea repository
+func repoPath(owner, name string) string {
+	return fmt.Sprintf("/repos/%s/%s", url.PathEscape(owner), url.PathEscape(name))
+}
+
+// mirrorSkipReason returns why the mirror's token must not be rotated, if so. Mirror
+// addresses from the API carry no credentials, so only the host and owner are checked.
+func (m *Mirror) mirrorSkipReason(remoteAddress, installationOwner string) string {
+	if !m.isGitHubURL(remoteAddress) {
+		return "not the configured GitHub host"
+	}
+	if installationOwner != "" {
+		parsed, err := url.Parse(remoteAddress)
+		if err != nil {
+			return "invalid remote URL"
+		}
+		owner, _ := repoFromURL(parsed)
+		if !strings.EqualFold(owner, installationOwner) {
+			return "owner is not covered by the installation"
+		}
+	}
+	return ""
+}
+
+// recreatePushMirror adds a copy of the push mirror authenticated with the token, then removes
+// the original. The copy is added first so the repository is never left without its mirror,
+// and is removed again if the original cannot be, so mirrors never pile up.
+func recreatePushMirror(api *giteaAPI, owner, name string, mirror pushMirror, token string) error {
+	path := repoPath(owner, name) + "/push_mirrors"
+	var created pushMirror
+	err := api.do(http.MethodPost, path, gitea.CreatePushMirrorOption{
+		RemoteAddress:  mirror.RemoteAddress,
+		RemoteUsername: "oauth2",
+		RemotePassword: token,
+		Interval:       mirror.Interval,
+		SyncONCommit:   mirror.SyncOnCommit,
+	}, &created)
+	if err != nil {
+		return fmt.Errorf("failed to create push mirror: %w", err)
+	}
+	if err := api.do(http.MethodDelete, path+"/"+url.PathEscape(mirror.RemoteName), nil, nil); err != nil {
+		if created.RemoteName == "" {
+			return fmt.Errorf("failed to delete old push mirror, and the new one cannot be identified to remove it: %w", err)
+		}
+		if rollbackErr := api.do(http.MethodDelete, path+"/"+url.PathEscape(created.RemoteName), nil, nil); rollbackErr != nil {
+			return fmt.Errorf("failed to delete old push mirror: %w, and failed to remove the new one: %w", err, rollbackErr)
+		}
+		return fmt.Errorf("failed to delete old push mirror: %w", err)
+	}
+	return nil
+}
+
+// searchGiteaRepos returns every repository visible to the Gitea token, which is every
+// repository on the instance for an admin token
+func searchGiteaRepos(api *giteaAPI) ([]*giteaRepository, error) {
+	const limit = 50
+	var repos []*giteaRepository
+	for page := 1; ; page++ {
+		var result struct {
+			Data []*giteaRepository `json:"data"`
+		}
+		if err := api.do(http.MethodGet, fmt.Sprintf("/repos/search?page=%d&limit=%d", page, limit), nil, &result); err != nil {
+			return nil, err
+		}
+		// Gitea may return fewer than limit per page, so only an empty page is the last
+		if len(result.Data) == 0 {
+			return repos, nil
+		}
+		repos = append(repos, result.Data...)
+	}
+}
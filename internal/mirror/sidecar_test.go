@@ -0,0 +1,68 @@
+package mirror
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFindReposStopsWhenDone(t *testing.T) {
+	t.Parallel()
+	root := t.TempDir()
+	for _, repo := range []string{"owner/one.git", "owner/two.git"} {
+		for _, dir := range []string{"objects", "refs"} {
+			if err := os.MkdirAll(filepath.Join(root, repo, dir), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, file := range []string{"HEAD", "config"} {
+			if err := os.WriteFile(filepath.Join(root, repo, file), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Nothing receives, as after the sidecar has stopped
+	reposChan := make(chan string)
+	done := make(chan struct{})
+	close(done)
+	finished := make(chan struct{})
+	go func() {
+		findRepos([]string{root}, reposChan, done)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("findRepos() blocked after done was closed")
+	}
+}
+
+func TestRepoFromURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		url   string
+		owner string
+		name  string
+	}{
+		{url: "https://github.com/owner/repo.git", owner: "owner", name: "repo"},
+		{url: "https://github.com/owner/repo.wiki.git", owner: "owner", name: "repo"},
+		{url: "https://github.com/owner/repo", owner: "owner", name: "repo"},
+		{url: "https://github.com/owner/", owner: "owner", name: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			t.Parallel()
+			parsed, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			owner, name := repoFromURL(parsed)
+			if owner != tt.owner || name != tt.name {
+				t.Fatalf("repoFromURL(%q) = %q, %q, want %q, %q", tt.url, owner, name, tt.owner, tt.name)
+			}
+		})
+	}
+}
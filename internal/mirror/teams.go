@@ -0,0 +1,432 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	"github.com/google/go-github/v62/github"
+)
+
+// repoTarget is the Gitea repository a GitHub repository is mirrored to
+type repoTarget struct {
+	Owner string
+	Name  string
+}
+
+// giteaPermissions orders Gitea access modes from least to most privileged
+//
+//nolint:golint,gochecknoglobals
+var giteaPermissions = []gitea.AccessMode{gitea.AccessModeRead, gitea.AccessModeWrite, gitea.AccessModeAdmin}
+
+// giteaTeamUnits are the repository units granted to synced teams
+//
+//nolint:golint,gochecknoglobals
+var giteaTeamUnits = []gitea.RepoUnitType{
+	gitea.RepoUnitCode,
+	gitea.RepoUnitIssues,
+	gitea.RepoUnitPulls,
+	gitea.RepoUnitReleases,
+	gitea.RepoUnitWiki,
+	gitea.RepoUnitProjects,
+}
+
+// githubTeam is a GitHub team along with the members and mirrored repositories to sync
+type githubTeam struct {
+	team       *github.Team
+	members    []string
+	repos      []repoTarget
+	permission gitea.AccessMode
+}
+
+// teamSyncer syncs GitHub organization teams onto Gitea teams
+type teamSyncer struct {
+	githubClient *github.Client
+	giteaClient  *gitea.Client
+	config       configPkg.TeamSyncConfig
+
+	// users caches the Gitea username for each GitHub login, or "" when there is none
+	users map[string]string
+}
+
+// syncTeams mirrors the teams of a GitHub organization, their members, and their permissions
+// on the repositories mirrored from it onto teams in the destination Gitea organizations
+func syncTeams(githubClient *github.Client, giteaClient *gitea.Client, mirror configPkg.MirrorConfig, mirrored map[string]repoTarget) error {
+	syncer := &teamSyncer{
+		githubClient: githubClient,
+		giteaClient:  giteaClient,
+		config:       mirror.Teams,
+		users:        make(map[string]string),
+	}
+
+	teams, err := syncer.listGitHubTeams(mirror.From.Name, mirrored)
+	if err != nil {
+		return err
+	}
+
+	// Mirrored repositories may be spread over several Gitea owners by name templates,
+	// so each destination organization gets the teams for its own repositories
+	for _, owner := range uniqueOwners(mirrored) {
+		if _, _, err := giteaClient.GetOrg(owner); err != nil {
+			slog.Warn("Skipping team sync for destination that is not an organization", "owner", owner)
+			continue
+		}
+		for _, team := range teams {
+			var repos []repoTarget
+			for _, repo := range team.repos {
+				if repo.Owner == owner {
+					repos = append(repos, repo)
+				}
+			}
+			if len(repos) == 0 {
+				continue
+			}
+			err := syncer.syncTeam(owner, team, repos, mirrored)
+			if err != nil {
+				slog.Error("Error syncing team", "org", owner, "team", team.team.GetSlug(), "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *teamSyncer) listGitHubTeams(org string, mirrored map[string]repoTarget) ([]githubTeam, error) {
+	var teams []githubTeam
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := s.githubClient.Teams.ListTeams(context.Background(), org, opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list teams: %w", err)
+		}
+		for _, team := range page {
+			synced := githubTeam{team: team}
+			synced.repos, synced.permission, err = s.listTeamRepos(org, team.GetSlug(), mirrored)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list repos of team %s: %w", team.GetSlug(), err)
+			}
+			if len(synced.repos) == 0 {
+				continue
+			}
+			synced.members, err = s.listTeamMembers(org, team.GetSlug())
+			if err != nil {
+				return nil, fmt.Errorf("failed to list members of team %s: %w", team.GetSlug(), err)
+			}
+			teams = append(teams, synced)
+		}
+		if resp.NextPage == 0 {
+			return teams, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// listTeamRepos returns the mirrored repositories a team has access to, and the lowest
+// permission the team has on any of them. Gitea teams have a single permission for all of
+// their repositories, so taking the highest would grant it on every other repository too.
+func (s *teamSyncer) listTeamRepos(org, slug string, mirrored map[string]repoTarget) ([]repoTarget, gitea.AccessMode, error) {
+	var repos []repoTarget
+	var permission gitea.AccessMode
+	mixed := false
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := s.githubClient.Teams.ListTeamReposBySlug(context.Background(), org, slug, opt)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, repo := range page {
+			target, ok := mirrored[repo.GetName()]
+			if !ok {
+				continue
+			}
+			repos = append(repos, target)
+			repoPermission := toGiteaPermission(repo.Permissions)
+			switch {
+			case permission == "":
+				permission = repoPermission
+			case repoPermission != permission:
+				mixed = true
+				if permissionRank(repoPermission) < permissionRank(permission) {
+					permission = repoPermission
+				}
+			}
+		}
+		if resp.NextPage == 0 {
+			if mixed {
+				slog.Warn("Team has different permissions on its repositories, granting the lowest on all of them", "team", slug, "permission", permission)
+			}
+			return repos, permission, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *teamSyncer) listTeamMembers(org, slug string) ([]string, error) {
+	var members []string
+	opt := &github.TeamListTeamMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := s.githubClient.Teams.ListTeamMembersBySlug(context.Background(), org, slug, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range page {
+			members = append(members, member.GetLogin())
+		}
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *teamSyncer) syncTeam(org string, team githubTeam, repos []repoTarget, mirrored map[string]repoTarget) error {
+	giteaTeam, err := s.ensureTeam(org, team)
+	if err != nil {
+		return err
+	}
+
+	// Members
+	current, err := s.listGiteaTeamMembers(giteaTeam.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list team members: %w", err)
+	}
+	desired := make(map[string]bool)
+	for _, login := range team.members {
+		username := s.giteaUser(login)
+		if username == "" {
+			slog.Warn("No Gitea user for GitHub team member, skipping", "team", giteaTeam.Name, "github-user", login)
+			continue
+		}
+		desired[strings.ToLower(username)] = true
+		if !current[strings.ToLower(username)] {
+			slog.Info("Adding team member", "org", org, "team", giteaTeam.Name, "user", username)
+			if _, err := s.giteaClient.AddTeamMember(giteaTeam.ID, username); err != nil {
+				slog.Error("Error adding team member", "team", giteaTeam.Name, "user", username, "error", err)
+			} else {
+				metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+			}
+		}
+	}
+	if s.config.RemoveMembers {
+		for username := range current {
+			if !desired[username] {
+				slog.Info("Removing team member", "org", org, "team", giteaTeam.Name, "user", username)
+				if _, err := s.giteaClient.RemoveTeamMember(giteaTeam.ID, username); err != nil {
+					slog.Error("Error removing team member", "team", giteaTeam.Name, "user", username, "error", err)
+				} else {
+					metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+				}
+			}
+		}
+	}
+
+	// Repositories. Only repositories mirrored from this source are ever removed,
+	// so repositories added to the team by hand are left alone.
+	currentRepos, err := s.listGiteaTeamRepos(giteaTeam.ID)
+	if err != nil {
+		return fmt.Errorf("failed to list team repos: %w", err)
+	}
+	desiredRepos := make(map[string]bool)
+	for _, repo := range repos {
+		desiredRepos[strings.ToLower(repo.Name)] = true
+		if !currentRepos[strings.ToLower(repo.Name)] {
+			slog.Info("Adding team repo", "org", org, "team", giteaTeam.Name, "repo", repo.Name)
+			if _, err := s.giteaClient.AddTeamRepository(giteaTeam.ID, org, repo.Name); err != nil {
+				slog.Error("Error adding team repo", "team", giteaTeam.Name, "repo", repo.Name, "error", err)
+			} else {
+				metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+			}
+		}
+	}
+	for _, repo := range mirrored {
+		name := strings.ToLower(repo.Name)
+		if repo.Owner == org && currentRepos[name] && !desiredRepos[name] {
+			slog.Info("Removing team repo", "org", org, "team", giteaTeam.Name, "repo", repo.Name)
+			if _, err := s.giteaClient.RemoveTeamRepository(giteaTeam.ID, org, repo.Name); err != nil {
+				slog.Error("Error removing team repo", "team", giteaTeam.Name, "repo", repo.Name, "error", err)
+			} else {
+				metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+			}
+		}
+	}
+	return nil
+}
+
+// ensureTeam returns the Gitea team named after the GitHub team's slug, creating it or
+// updating its permission as needed
+func (s *teamSyncer) ensureTeam(org string, team githubTeam) (*gitea.Team, error) {
+	name := team.team.GetSlug()
+	if strings.EqualFold(name, "owners") {
+		return nil, fmt.Errorf("the owners team is reserved by Gitea")
+	}
+
+	opt := gitea.ListTeamsOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}}
+	for {
+		teams, resp, err := s.giteaClient.ListOrgTeams(org, opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list teams: %w", err)
+		}
+		for _, giteaTeam := range teams {
+			if !strings.EqualFold(giteaTeam.Name, name) {
+				continue
+			}
+			if giteaTeam.Permission != team.permission {
+				slog.Info("Updating team permission", "org", org, "team", name, "permission", team.permission)
+				description := team.team.GetDescription()
+				_, err := s.giteaClient.EditTeam(giteaTeam.ID, gitea.EditTeamOption{
+					Name:        giteaTeam.Name,
+					Description: &description,
+					Permission:  team.permission,
+					Units:       giteaTeamUnits,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to update team: %w", err)
+				}
+				metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+			}
+			return giteaTeam, nil
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	slog.Info("Creating team", "org", org, "team", name, "permission", team.permission)
+	giteaTeam, _, err := s.giteaClient.CreateTeam(org, gitea.CreateTeamOption{
+		Name:        name,
+		Description: truncate(team.team.GetDescription(), 255),
+		Permission:  team.permission,
+		Units:       giteaTeamUnits,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create team: %w", err)
+	}
+	metrics.ReconcileChanges.WithLabelValues("teams").Inc()
+	return giteaTeam, nil
+}
+
+func (s *teamSyncer) listGiteaTeamMembers(id int64) (map[string]bool, error) {
+	members := make(map[string]bool)
+	opt := gitea.ListTeamMembersOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}}
+	for {
+		users, resp, err := s.giteaClient.ListTeamMembers(id, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			members[strings.ToLower(user.UserName)] = true
+		}
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (s *teamSyncer) listGiteaTeamRepos(id int64) (map[string]bool, error) {
+	repos := make(map[string]bool)
+	opt := gitea.ListTeamRepositoriesOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: 50}}
+	for {
+		page, resp, err := s.giteaClient.ListTeamRepositories(id, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range page {
+			repos[strings.ToLower(repo.Name)] = true
+		}
+		if resp.NextPage == 0 {
+			return repos, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// giteaUser maps a GitHub login to a Gitea username, first through the configured user
+// mapping, then by username, then optionally by public email address
+func (s *teamSyncer) giteaUser(login string) string {
+	if username, ok := s.users[login]; ok {
+		return username
+	}
+	username := s.resolveGiteaUser(login)
+	s.users[login] = username
+	return username
+}
+
+func (s *teamSyncer) resolveGiteaUser(login string) string {
+	for githubUser, giteaUser := range s.config.Users {
+		if strings.EqualFold(githubUser, login) {
+			return giteaUser
+		}
+	}
+
+	user, resp, err := s.giteaClient.GetUserInfo(login)
+	if err == nil {
+		return user.UserName
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		slog.Error("Error getting Gitea user", "user", login, "error", err)
+		return ""
+	}
+
+	if !s.config.MatchByEmail {
+		return ""
+	}
+	githubUser, _, err := s.githubClient.Users.Get(context.Background(), login)
+	if err != nil {
+		slog.Error("Error getting GitHub user", "user", login, "error", err)
+		return ""
+	}
+	email := githubUser.GetEmail()
+	if email == "" {
+		return ""
+	}
+	users, _, err := s.giteaClient.SearchUsers(gitea.SearchUsersOption{KeyWord: email})
+	if err != nil {
+		slog.Error("Error searching Gitea users", "email", email, "error", err)
+		return ""
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.Email, email) {
+			return user.UserName
+		}
+	}
+	return ""
+}
+
+// toGiteaPermission maps a GitHub repository permission set onto a Gitea access mode
+func toGiteaPermission(permissions map[string]bool) gitea.AccessMode {
+	switch {
+	case permissions["admin"]:
+		return gitea.AccessModeAdmin
+	case permissions["maintain"], permissions["push"]:
+		return gitea.AccessModeWrite
+	default:
+		return gitea.AccessModeRead
+	}
+}
+
+func permissionRank(permission gitea.AccessMode) int {
+	for i, p := range giteaPermissions {
+		if p == permission {
+			return i
+		}
+	}
+	return -1
+}
+
+func uniqueOwners(mirrored map[string]repoTarget) []string {
+	seen := make(map[string]bool)
+	var owners []string
+	for _, target := range mirrored {
+		if !seen[target.Owner] {
+			seen[target.Owner] = true
+			owners = append(owners, target.Owner)
+		}
+	}
+	return owners
+}
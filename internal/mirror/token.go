@@ -0,0 +1,233 @@
+package mirror
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/google/go-github/v62/github"
+)
+
+// tokenRefreshMargin is how long before an installation token expires that it is replaced,
+// leaving time to rewrite every remote before the old token stops working
+const tokenRefreshMargin = 10 * time.Minute
+
+// installationToken is a minted GitHub App installation token
+type installationToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// tokenAccess is what a token is used for, which decides the permissions it is minted with
+type tokenAccess string
+
+var (
+	// accessFetch is for fetching a pull mirror
+	accessFetch tokenAccess = "fetch"
+	// accessMigrate is for the initial migration, which also imports issues and pull requests
+	accessMigrate tokenAccess = "migrate"
+	// accessPush is for pushing a push mirror
+	accessPush tokenAccess = "push"
+)
+
+func (a tokenAccess) permissions() *github.InstallationPermissions {
+	switch a {
+	case accessMigrate:
+		return &github.InstallationPermissions{
+			Contents:     github.String("read"),
+			Metadata:     github.String("read"),
+			Issues:       github.String("read"),
+			PullRequests: github.String("read"),
+		}
+	case accessPush:
+		return &github.InstallationPermissions{
+			Contents: github.String("write"),
+			Metadata: github.String("read"),
+		}
+	default:
+		return &github.InstallationPermissions{
+			Contents: github.String("read"),
+			Metadata: github.String("read"),
+		}
+	}
+}
+
+// tokenScope is what a token can access. Tokens are cached per scope.
+type tokenScope struct {
+	installationID int64
+	// repository is the only repository the token can access, or empty for the whole installation
+	repository string
+	// access is what the token is used for, or empty for all of the installation's permissions
+	access tokenAccess
+}
+
+// newTokenScope returns the scope of a token for the repository, which is the whole
+// installation unless tokens are scoped to repositories
+func newTokenScope(config *configPkg.Config, installationID int64, repository string, access tokenAccess) tokenScope {
+	if config.GetTokenScope() == configPkg.TokenScopeInstallation {
+		return tokenScope{installationID: installationID}
+	}
+	return tokenScope{
+		installationID: installationID,
+		repository:     strings.ToLower(repository),
+		access:         access,
+	}
+}
+
+// notInstalledRecheck is how long a repository the GitHub App is not installed on is
+// remembered before looking it up again
+const notInstalledRecheck = time.Hour
+
+// installationTokenCache mints one installation token per scope and reuses it until shortly
+// before it expires, rather than minting a token every time one is needed. It also caches
+// which installation covers each repository owner. GitHub is called without holding mu, and
+// concurrent callers needing the same token or installation wait for the one call in flight.
+type installationTokenCache struct {
+	mu     sync.Mutex
+	tokens map[tokenScope]installationToken
+	// owners maps lowercased owner logins to their installation ID
+	owners map[string]int64
+	// notInstalled maps lowercased owner/name to when the repository was found to have no installation
+	notInstalled map[string]time.Time
+	// minting and finding are the token mints and installation lookups in flight
+	minting map[tokenScope]*githubCall[installationToken]
+	finding map[string]*githubCall[int64]
+}
+
+// githubCall is a GitHub request in flight. Its result is set before done is closed.
+type githubCall[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+//nolint:golint,gochecknoglobals
+var installationTokens = &installationTokenCache{
+	tokens:       make(map[tokenScope]installationToken),
+	owners:       make(map[string]int64),
+	notInstalled: make(map[string]time.Time),
+	minting:      make(map[tokenScope]*githubCall[installationToken]),
+	finding:      make(map[string]*githubCall[int64]),
+}
+
+// installationFor returns the ID of the GitHub App installation covering the repository,
+// or 0 if the App is not installed on it
+func (c *installationTokenCache) installationFor(githubAppClient *github.Client, owner, name string) (int64, error) {
+	ownerKey := strings.ToLower(owner)
+	repoKey := ownerKey + "/" + strings.ToLower(name)
+	c.mu.Lock()
+	if id, ok := c.owners[ownerKey]; ok {
+		c.mu.Unlock()
+		return id, nil
+	}
+	if checkedAt, ok := c.notInstalled[repoKey]; ok && time.Since(checkedAt) < notInstalledRecheck {
+		c.mu.Unlock()
+		return 0, nil
+	}
+	if call, ok := c.finding[repoKey]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+	call := &githubCall[int64]{done: make(chan struct{})}
+	c.finding[repoKey] = call
+	c.mu.Unlock()
+	defer close(call.done)
+
+	installation, resp, err := githubAppClient.Apps.FindRepositoryInstallation(context.Background(), owner, name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.finding, repoKey)
+	switch {
+	case err != nil && resp != nil && resp.StatusCode == http.StatusNotFound:
+		c.notInstalled[repoKey] = time.Now()
+	case err != nil:
+		call.err = err
+	default:
+		c.owners[ownerKey] = installation.GetID()
+		call.value = installation.GetID()
+	}
+	return call.value, call.err
+}
+
+// get returns a token for the scope that is valid for at least tokenRefreshMargin, along
+// with its expiry
+func (c *installationTokenCache) get(githubAppClient *github.Client, scope tokenScope) (string, time.Time, error) {
+	c.mu.Lock()
+	if cached, ok := c.tokens[scope]; ok && time.Until(cached.expiresAt) > tokenRefreshMargin {
+		c.mu.Unlock()
+		return cached.token, cached.expiresAt, nil
+	}
+	if call, ok := c.minting[scope]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.value.token, call.value.expiresAt, call.err
+	}
+	call := &githubCall[installationToken]{done: make(chan struct{})}
+	c.minting[scope] = call
+	c.mu.Unlock()
+	defer close(call.done)
+
+	opts := &github.InstallationTokenOptions{}
+	if scope.repository != "" {
+		opts.Repositories = []string{scope.repository}
+	}
+	if scope.access != "" {
+		opts.Permissions = scope.access.permissions()
+	}
+	installToken, resp, err := githubAppClient.Apps.CreateInstallationToken(context.Background(), scope.installationID, opts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.minting, scope)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized) {
+			// The App was uninstalled or reinstalled, so look the installation up again next time
+			c.forgetInstallation(scope.installationID)
+		}
+		call.err = err
+		return "", time.Time{}, err
+	}
+	minted := installationToken{
+		token:     installToken.GetToken(),
+		expiresAt: installToken.GetExpiresAt().Time,
+	}
+	// GitHub documents installation tokens as lasting an hour
+	if minted.expiresAt.IsZero() {
+		minted.expiresAt = time.Now().Add(time.Hour)
+	}
+	// Repository scoped tokens add up, so forget the ones that have expired
+	for cachedScope, cached := range c.tokens {
+		if time.Now().After(cached.expiresAt) {
+			delete(c.tokens, cachedScope)
+		}
+	}
+	c.tokens[scope] = minted
+	call.value = minted
+	return minted.token, minted.expiresAt, nil
+}
+
+// forgetInstallation drops the owners and tokens cached for an installation. The caller must hold mu.
+func (c *installationTokenCache) forgetInstallation(installationID int64) {
+	for owner, id := range c.owners {
+		if id == installationID {
+			delete(c.owners, owner)
+		}
+	}
+	for scope := range c.tokens {
+		if scope.installationID == installationID {
+			delete(c.tokens, scope)
+		}
+	}
+}
+
+// nextRefresh returns how long to wait before tokens expiring at expiresAt must be replaced
+func nextRefresh(expiresAt time.Time) time.Duration {
+	wait := time.Until(expiresAt) - tokenRefreshMargin
+	if wait < time.Minute {
+		return time.Minute
+	}
+	return wait
+}
@@ -0,0 +1,73 @@
+package mirror
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v62/github"
+)
+
+func TestInstallationTokenCacheConcurrent(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	var mints atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/installations/2/access_tokens" {
+			// A hung GitHub call for another installation
+			<-release
+		} else {
+			mints.Add(1)
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"token":"token-%s","expires_at":%q}`, r.URL.Path, time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	cache := &installationTokenCache{
+		tokens:       make(map[tokenScope]installationToken),
+		owners:       make(map[string]int64),
+		notInstalled: make(map[string]time.Time),
+		minting:      make(map[tokenScope]*githubCall[installationToken]),
+		finding:      make(map[string]*githubCall[int64]),
+	}
+
+	go func() {
+		_, _, _ = cache.get(client, tokenScope{installationID: 2})
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				token, _, err := cache.get(client, tokenScope{installationID: 1})
+				if err != nil || token != "token-/app/installations/1/access_tokens" {
+					t.Errorf("get() = %q, %v", token, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("get() blocked behind a call for another installation")
+	}
+	if got := mints.Load(); got != 1 {
+		t.Fatalf("minted %d tokens, want 1", got)
+	}
+}
@@ -0,0 +1,73 @@
+package mirror
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/google/go-github/v62/github"
+)
+
+// syncTopics sets the Gitea repository's topics to the GitHub repository's topics, after
+// applying the allow-list, prefix, and extra topics. It returns true if the topics changed.
+func syncTopics(giteaClient *gitea.Client, config configPkg.TopicSyncConfig, owner, name string, githubRepo *github.Repository) (bool, error) {
+	desired := desiredTopics(config, githubRepo.Topics)
+
+	current, _, err := giteaClient.ListRepoTopics(owner, name, gitea.ListRepoTopicsOptions{
+		ListOptions: gitea.ListOptions{Page: 1, PageSize: configPkg.MaxTopics * 2},
+	})
+	if err != nil {
+		return false, err
+	}
+	slices.Sort(current)
+	if slices.Equal(current, desired) {
+		return false, nil
+	}
+
+	slog.Info("Updating topics", "repo", owner+"/"+name, "topics", desired)
+	if _, err := giteaClient.SetRepoTopics(owner, name, desired); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// desiredTopics returns the sorted, deduplicated topics a mirrored repository should have.
+// The extra topics are always kept, and the GitHub topics fill the rest of Gitea's limit.
+func desiredTopics(config configPkg.TopicSyncConfig, githubTopics []string) []string {
+	extra := make([]string, 0, len(config.Extra))
+	for _, topic := range config.Extra {
+		extra = append(extra, strings.ToLower(topic))
+	}
+	slices.Sort(extra)
+	extra = slices.Compact(extra)
+
+	topics := make([]string, 0, len(githubTopics))
+	for _, topic := range githubTopics {
+		topic = strings.ToLower(topic)
+		if len(config.Allow) > 0 && !slices.ContainsFunc(config.Allow, func(allowed string) bool {
+			return strings.EqualFold(allowed, topic)
+		}) {
+			continue
+		}
+		topic = config.Prefix + topic
+		if !configPkg.ValidTopic(topic) {
+			slog.Warn("Skipping topic that is invalid in Gitea", "topic", topic)
+			continue
+		}
+		if !slices.Contains(extra, topic) {
+			topics = append(topics, topic)
+		}
+	}
+
+	slices.Sort(topics)
+	topics = slices.Compact(topics)
+	if room := configPkg.MaxTopics - len(extra); len(topics) > room {
+		slog.Warn("Too many topics for Gitea, truncating", "topics", topics)
+		topics = topics[:max(room, 0)]
+	}
+	topics = append(topics, extra...)
+	slices.Sort(topics)
+	return topics
+}
@@ -0,0 +1,31 @@
+package mirror
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+)
+
+func TestDesiredTopicsKeepsExtra(t *testing.T) {
+	t.Parallel()
+	githubTopics := make([]string, 0, 30)
+	for i := range 30 {
+		githubTopics = append(githubTopics, fmt.Sprintf("topic-%02d", i))
+	}
+	config := configPkg.TopicSyncConfig{Extra: []string{"Zz-mirror", "zz-mirror", "zz-team"}}
+
+	topics := desiredTopics(config, githubTopics)
+	if len(topics) != configPkg.MaxTopics {
+		t.Fatalf("desiredTopics() returned %d topics, want %d", len(topics), configPkg.MaxTopics)
+	}
+	for _, extra := range []string{"zz-mirror", "zz-team"} {
+		if !slices.Contains(topics, extra) {
+			t.Fatalf("desiredTopics() = %v, missing extra topic %q", topics, extra)
+		}
+	}
+	if !slices.IsSorted(topics) {
+		t.Fatalf("desiredTopics() = %v, want sorted topics", topics)
+	}
+}
@@ -0,0 +1,194 @@
+package mirror
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a new repository must be left alone before it is refreshed, so
+// Gitea has finished writing its git config
+const watchDebounce = 10 * time.Second
+
+// repoWatcher reports repositories created under the repos path as soon as they appear,
+// rather than waiting for the next walk of the repos path
+type repoWatcher struct {
+	basePath  string
+	reposChan chan string
+	// done is closed when nothing receives from reposChan any more
+	done    <-chan struct{}
+	watcher *fsnotify.Watcher
+
+	mu sync.Mutex
+	// watched is every directory being watched, which are the directories that are not
+	// repositories or inside one
+	watched map[string]bool
+	pending map[string]*time.Timer
+}
+
+// watchRepos watches basePath and every directory under it, outside of repositories, for
+// new repositories, which are sent to reposChan until done is closed. Like findRepos, any
+// directory layout works. Close the returned watcher to stop watching.
+func watchRepos(basePath string, reposChan chan string, done <-chan struct{}) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &repoWatcher{
+		basePath:  filepath.Clean(basePath),
+		reposChan: reposChan,
+		done:      done,
+		watcher:   watcher,
+		watched:   make(map[string]bool),
+		pending:   make(map[string]*time.Timer),
+	}
+	if err := watcher.Add(basePath); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	w.watched[w.basePath] = true
+	w.watchTree(basePath, false)
+	go w.run()
+	return watcher, nil
+}
+
+func (w *repoWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				w.mu.Lock()
+				for _, timer := range w.pending {
+					timer.Stop()
+				}
+				w.mu.Unlock()
+				return
+			}
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+				continue
+			}
+			// A directory being filled in by git init becomes a repository once its last
+			// file or directory appears. Events queued from inside a repository found since
+			// lead back to it too.
+			if repo := w.containingRepo(filepath.Dir(event.Name)); repo != "" {
+				w.foundRepo(repo)
+				continue
+			}
+			info, err := os.Stat(event.Name)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			// A new directory may already contain repositories, such as a renamed owner
+			w.watchTree(event.Name, true)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Error watching repos", "error", err)
+		}
+	}
+}
+
+// watchTree watches every directory under root that is not a repository or inside one. With
+// scan set, repositories that were created before the watches were added are scheduled too.
+func (w *repoWatcher) watchTree(root string, scan bool) {
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Error("Error walking path", "path", path, "error", err)
+			if entry != nil && entry.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if entry.Name() == ".git" {
+			// The git directory of a non-bare repository
+			if scan {
+				w.foundRepo(filepath.Dir(path))
+			}
+			return filepath.SkipDir
+		}
+		if isBareRepo(path) {
+			if scan {
+				w.foundRepo(path)
+			}
+			return filepath.SkipDir
+		}
+		w.watch(path)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error walking path", "path", root, "error", err)
+	}
+}
+
+func (w *repoWatcher) watch(path string) {
+	path = filepath.Clean(path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watched[path] {
+		return
+	}
+	if err := w.watcher.Add(path); err != nil {
+		slog.Error("Error watching directory", "path", path, "error", err)
+		return
+	}
+	w.watched[path] = true
+}
+
+// foundRepo stops watching inside the repository, which was watched while git created it,
+// and schedules it
+func (w *repoWatcher) foundRepo(repo string) {
+	repo = filepath.Clean(repo)
+	w.mu.Lock()
+	for path := range w.watched {
+		if path == repo || strings.HasPrefix(path, repo+string(filepath.Separator)) {
+			if err := w.watcher.Remove(path); err != nil {
+				slog.Debug("Error unwatching directory", "path", path, "error", err)
+			}
+			delete(w.watched, path)
+		}
+	}
+	w.mu.Unlock()
+	w.schedule(repo)
+}
+
+// schedule sends the repository after watchDebounce, restarting the wait if it is scheduled again
+func (w *repoWatcher) schedule(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if timer, ok := w.pending[path]; ok {
+		timer.Reset(watchDebounce)
+		return
+	}
+	w.pending[path] = time.AfterFunc(watchDebounce, func() {
+		w.mu.Lock()
+		delete(w.pending, path)
+		w.mu.Unlock()
+		slog.Info("New repo created", "repo", path)
+		select {
+		case w.reposChan <- path:
+		case <-w.done:
+		}
+	})
+}
+
+// containingRepo returns the bare repository under the repos path that is path or one of its
+// parents, or "" if there is none
+func (w *repoWatcher) containingRepo(path string) string {
+	for path != w.basePath && strings.HasPrefix(path, w.basePath+string(filepath.Separator)) {
+		if isBareRepo(path) {
+			return path
+		}
+		path = filepath.Dir(path)
+	}
+	return ""
+}
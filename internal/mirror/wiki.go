@@ -0,0 +1,109 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"code.gitea.io/sdk/gitea"
+	configPkg "github.com/USA-RedDragon/gitea-mirror/internal/config"
+	"github.com/USA-RedDragon/gitea-mirror/internal/metrics"
+	git "github.com/go-git/go-git/v5"
+	gitConfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/google/go-github/v62/github"
+)
+
+// defaultWikiSuffix is added to the repository name to name its wiki mirror
+const defaultWikiSuffix = "-wiki"
+
+// ensureWikiMirror creates a Gitea pull mirror of the GitHub repository's wiki, if the wiki
+// has any pages and no mirror of it exists yet. Gitea keeps it in sync like any other mirror.
+// The wiki's target is registered in targets, so it cannot silently take the place of a
+// repository, or the other way round.
+func ensureWikiMirror(config *configPkg.Config, githubAppClient *github.Client, giteaClient *gitea.Client, wikiConfig configPkg.WikiSyncConfig, owner, name string, githubRepo *github.Repository, targets map[string]string) error {
+	suffix := wikiConfig.Suffix
+	if suffix == "" {
+		suffix = defaultWikiSuffix
+	}
+	wikiName := name + suffix
+	wikiSource := githubRepo.GetFullName() + ".wiki"
+	wikiURL := strings.TrimSuffix(githubRepo.GetCloneURL(), ".git") + ".wiki.git"
+
+	target := strings.ToLower(owner + "/" + wikiName)
+	if source, ok := targets[target]; ok && source != wikiSource {
+		return fmt.Errorf("wiki target %s/%s collides with %s", owner, wikiName, source)
+	}
+
+	if foundRepo, _, err := giteaClient.GetRepo(owner, wikiName); err == nil && foundRepo != nil {
+		// Mirrors created through the proxy sidecar have the proxy's host, but the same path
+		if !foundRepo.Mirror || !strings.HasSuffix(strings.ToLower(foundRepo.OriginalURL), strings.ToLower("/"+wikiSource+".git")) {
+			return fmt.Errorf("wiki target %s/%s is taken by a repository that does not mirror the wiki", owner, wikiName)
+		}
+		targets[target] = wikiSource
+		return nil
+	}
+
+	token, err := mirroringToken(config, githubAppClient, githubRepo.GetName(), accessFetch)
+	if err != nil {
+		return fmt.Errorf("failed to create installation token: %w", err)
+	}
+
+	exists, err := wikiExists(wikiURL, token)
+	if err != nil {
+		return fmt.Errorf("failed to check for wiki: %w", err)
+	}
+	if !exists {
+		// GitHub only creates the wiki repository once the first page is saved
+		return nil
+	}
+	targets[target] = wikiSource
+
+	slog.Info("Mirroring wiki", "repository", githubRepo.GetFullName(), "target", owner+"/"+wikiName)
+	migrateOptions := gitea.MigrateRepoOption{
+		RepoName:       wikiName,
+		RepoOwner:      owner,
+		Service:        gitea.GitServicePlain,
+		CloneAddr:      wikiURL,
+		AuthUsername:   "oauth2",
+		AuthPassword:   token,
+		Private:        githubRepo.GetPrivate(),
+		Description:    fmt.Sprintf("Wiki of %s", githubRepo.GetFullName()),
+		Mirror:         true,
+		MirrorInterval: "10m",
+	}
+	if config.SidecarProxyURL != "" {
+		migrateOptions.CloneAddr, err = proxyCloneURL(config.SidecarProxyURL, wikiURL)
+		if err != nil {
+			return fmt.Errorf("failed to build proxy URL: %w", err)
+		}
+		migrateOptions.AuthUsername = ""
+		migrateOptions.AuthPassword = ""
+	}
+	if _, _, err := giteaClient.MigrateRepo(migrateOptions); err != nil {
+		return err
+	}
+	metrics.ReconcileChanges.WithLabelValues("wiki").Inc()
+	return nil
+}
+
+// wikiExists returns true if the wiki repository exists and has at least one ref
+func wikiExists(wikiURL, token string) (bool, error) {
+	remote := git.NewRemote(memory.NewStorage(), &gitConfig.RemoteConfig{
+		Name: "origin",
+		URLs: []string{wikiURL},
+	})
+	refs, err := remote.List(&git.ListOptions{
+		Auth: &http.BasicAuth{Username: "oauth2", Password: token},
+	})
+	if errors.Is(err, transport.ErrRepositoryNotFound) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(refs) > 0, nil
+}
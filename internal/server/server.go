@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Checks reports whether gitea-mirror is working
+type Checks interface {
+	// Live returns an error if gitea-mirror has stalled and should be restarted
+	Live() error
+	// Ready returns an error until gitea-mirror is able to do its work
+	Ready() error
+}
+
+// Server serves the endpoints used to monitor gitea-mirror
+type Server struct {
+	server *http.Server
+}
+
+// New returns a server for the address, serving Prometheus metrics on /metrics and the
+// liveness and readiness checks on /healthz and /readyz
+func New(addr string, checks Checks) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", checkHandler(checks.Live))
+	mux.HandleFunc("GET /readyz", checkHandler(checks.Ready))
+	return &Server{
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Start serves in the background
+func (s *Server) Start() {
+	go func() {
+		slog.Info("HTTP server listening", "address", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving HTTP", "error", err)
+		}
+	}()
+}
+
+// Stop stops the server, giving requests in flight time to finish
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		slog.Error("Error stopping HTTP server", "error", err)
+	}
+}
+
+// checkHandler responds with 200 when the check passes, and 503 with the error when it fails
+func checkHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,111 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RepoState is the persisted sync state of a single mirrored repository
+type RepoState struct {
+	// IssuesBaseline is the time up to which the repository's issues were imported by the
+	// initial migration. Issues and comments created before it already exist in Gitea.
+	IssuesBaseline time.Time `json:"issues-baseline"`
+	// IssuesSyncedAt is the start time of the last completed issue sync
+	IssuesSyncedAt time.Time `json:"issues-synced-at"`
+	// Issues maps GitHub issue and pull request numbers to Gitea issues
+	Issues map[int]IssueState `json:"issues"`
+	// Comments maps GitHub comment IDs to Gitea comment IDs
+	Comments map[int64]int64 `json:"comments"`
+}
+
+// IssueState is the Gitea issue a GitHub issue or pull request is synced to
+type IssueState struct {
+	// Index is the Gitea issue index
+	Index int64 `json:"index"`
+	// Created is true if the issue was created by the sync rather than the initial migration
+	Created bool `json:"created"`
+}
+
+// State is the sync state of all mirrored repositories, persisted as a JSON file
+type State struct {
+	path string
+	mu   sync.Mutex
+
+	Repos map[string]*RepoState `json:"repos"`
+}
+
+// Load reads the state from path. A missing file results in an empty state.
+func Load(path string) (*State, error) {
+	state := &State{
+		path:  path,
+		Repos: make(map[string]*RepoState),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state: %w", err)
+	}
+	if state.Repos == nil {
+		state.Repos = make(map[string]*RepoState)
+	}
+	return state, nil
+}
+
+// Repo returns the state of the repository with the given key, creating it if needed
+func (s *State) Repo(key string) *RepoState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	repo, ok := s.Repos[key]
+	if !ok {
+		repo = &RepoState{}
+		s.Repos[key] = repo
+	}
+	if repo.Issues == nil {
+		repo.Issues = make(map[int]IssueState)
+	}
+	if repo.Comments == nil {
+		repo.Comments = make(map[int64]int64)
+	}
+	return repo
+}
+
+// Save atomically writes the state back to its file
+func (s *State) Save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state: %w", err)
+	}
+	return nil
+}